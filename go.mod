@@ -1,12 +1,41 @@
 module github.com/ryotarai/mallet
 
-go 1.14
+go 1.21
 
 require (
+	github.com/google/nftables v0.2.1-0.20240414091927-5e242ec57806
+	github.com/gorilla/websocket v1.4.2
+	github.com/jpillora/backoff v1.0.0
 	github.com/jpillora/chisel v1.6.0
-	github.com/mitchellh/go-ps v1.0.0
+	github.com/mdlayher/netlink v1.7.2
+	github.com/miekg/dns v1.1.29
+	github.com/prometheus/client_golang v1.7.0
 	github.com/rs/zerolog v1.19.0
 	github.com/spf13/cobra v1.0.0
+	github.com/spf13/pflag v1.0.3
+	golang.org/x/crypto v0.21.0
+	golang.org/x/net v0.22.0
+	golang.org/x/sys v0.18.0
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/armon/go-socks5 v0.0.0-20160902184237-e75332964ef5 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.1 // indirect
+	github.com/fsnotify/fsnotify v1.4.9 // indirect
+	github.com/golang/protobuf v1.4.2 // indirect
+	github.com/google/go-cmp v0.6.0 // indirect
+	github.com/inconshreveable/mousetrap v1.0.0 // indirect
+	github.com/josharian/native v1.1.0 // indirect
+	github.com/jpillora/sizestr v1.0.0 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/mdlayher/socket v0.5.0 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.10.0 // indirect
+	github.com/prometheus/procfs v0.1.3 // indirect
+	golang.org/x/sync v0.6.0 // indirect
+	google.golang.org/protobuf v1.23.0 // indirect
 )
 
 replace github.com/jpillora/chisel => github.com/ryotarai/chisel v1.6.0-ryotarai-mallet.1
@@ -1,29 +1,126 @@
 package cli
 
 import (
+	"fmt"
+
 	"github.com/ryotarai/mallet/pkg/nat"
+	"github.com/ryotarai/mallet/pkg/state"
 	"github.com/spf13/cobra"
 )
 
 var cleanupFlags struct {
+	natBackend string
+	stateDir   string
+	all        bool
+	pid        int
 }
 
 func init() {
 	c := &cobra.Command{
 		Use: "cleanup",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			nat, err := nat.New(logger, -1)
+			if cleanupFlags.all && cleanupFlags.pid != 0 {
+				return fmt.Errorf("only one of --all and --pid can be specified")
+			}
+
+			if err := cleanupStates(cleanupFlags.stateDir, cleanupFlags.all, cleanupFlags.pid); err != nil {
+				return err
+			}
+			if cleanupFlags.pid != 0 {
+				return nil
+			}
+
+			n, err := nat.New(logger, -1, 0, false, cleanupFlags.natBackend, nat.CommandExecutor{})
 			if err != nil {
 				return err
 			}
 
-			if err := nat.Cleanup(); err != nil {
+			ruleSets, err := n.ListRuleSets()
+			if err != nil {
 				return err
 			}
 
-			return nil
+			if cleanupFlags.all {
+				return n.DeleteRuleSets(ruleSets)
+			}
+
+			states, err := state.Load(cleanupFlags.stateDir)
+			if err != nil {
+				return err
+			}
+			recorded := map[string]bool{}
+			for _, s := range states {
+				for _, r := range s.RuleSets {
+					recorded[r.String()] = true
+				}
+			}
+			// rules not recorded, e.g. installed by versions without state files, are deleted if their process does not exist
+			var orphans []nat.RuleSet
+			for _, r := range ruleSets {
+				if recorded[r.String()] {
+					continue
+				}
+				if pid, ok := r.PID(); ok && !state.ProcessExists(pid) {
+					logger.Info().Str("ruleSet", r.String()).Msg("Deleting rules of a process which does not exist")
+					orphans = append(orphans, r)
+					continue
+				}
+				logger.Warn().Str("ruleSet", r.String()).Msg("Found rules not recorded in state files of a running process, which are deleted only with --all")
+			}
+			if len(orphans) == 0 {
+				return nil
+			}
+
+			return n.DeleteRuleSets(orphans)
 		},
 	}
 
+	c.Flags().StringVar(&cleanupFlags.natBackend, "nat-backend", nat.BackendAuto, "NAT backend (one of auto, iptables, nftables, netlink and pf)")
+	c.Flags().StringVar(&cleanupFlags.stateDir, "state-dir", state.DefaultDir, "directory of state files which record rules installed by each process")
+	c.Flags().BoolVar(&cleanupFlags.all, "all", false, "delete all rules installed by mallet, including ones of running processes and ones not recorded in state files")
+	c.Flags().IntVar(&cleanupFlags.pid, "pid", 0, "delete rules recorded in the state file of the process even if it is running")
+
 	rootCmd.AddCommand(c)
 }
+
+// cleanupStates deletes rules recorded in state files in dir and the files.
+// Rules of running processes are deleted only if all is true or pid is their process ID.
+func cleanupStates(dir string, all bool, pid int) error {
+	states, err := state.Load(dir)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, s := range states {
+		if pid != 0 && s.PID != pid {
+			continue
+		}
+		found = true
+
+		if s.IsRunning() {
+			if !all && pid == 0 {
+				continue
+			}
+			logger.Warn().Int("pid", s.PID).Msg("Deleting rules of a running process")
+		}
+
+		logger.Info().Int("pid", s.PID).Time("startedAt", s.StartedAt).Msg("Deleting rules recorded in the state file")
+		n, err := nat.New(logger, -1, 0, false, s.Backend, nat.CommandExecutor{})
+		if err != nil {
+			return err
+		}
+		if err := n.DeleteRuleSets(s.RuleSets); err != nil {
+			return err
+		}
+		if err := state.Remove(dir, s.PID); err != nil {
+			return err
+		}
+	}
+
+	if pid != 0 && !found {
+		return fmt.Errorf("state file of process %d is not found in %s", pid, dir)
+	}
+
+	return nil
+}
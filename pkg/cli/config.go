@@ -0,0 +1,79 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ryotarai/mallet/pkg/config"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var loadedConfig = &config.Config{}
+
+func loadConfig(cmd *cobra.Command) error {
+	if rootFlags.configPath == "" {
+		return nil
+	}
+
+	c, err := config.Load(rootFlags.configPath)
+	if err != nil {
+		return err
+	}
+	loadedConfig = c
+
+	return applyConfigFlags(cmd, c.Flags)
+}
+
+// applyConfigFlags sets flag values from a config file.
+// Flags specified in command line take precedence over the config file.
+func applyConfigFlags(cmd *cobra.Command, values map[string]interface{}) error {
+	for name, value := range values {
+		flag := cmd.Flags().Lookup(name)
+		if flag == nil {
+			if !isKnownFlag(cmd.Root(), name) {
+				return fmt.Errorf("unknown key in config file: %s", name)
+			}
+			// the key is for other commands
+			continue
+		}
+
+		if flag.Changed {
+			continue
+		}
+
+		if err := setFlag(cmd.Flags(), flag, value); err != nil {
+			return fmt.Errorf("invalid value of %s in config file: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func setFlag(flags *pflag.FlagSet, flag *pflag.Flag, value interface{}) error {
+	items, ok := value.([]interface{})
+	if !ok {
+		return flags.Set(flag.Name, fmt.Sprint(value))
+	}
+
+	if t := flag.Value.Type(); !strings.HasSuffix(t, "Slice") && !strings.HasSuffix(t, "Array") {
+		return fmt.Errorf("list is given but %s is not a list", flag.Name)
+	}
+	for _, item := range items {
+		// the first Set replaces the default value and the others append to it
+		if err := flags.Set(flag.Name, fmt.Sprint(item)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func isKnownFlag(root *cobra.Command, name string) bool {
+	for _, c := range root.Commands() {
+		if c.Flags().Lookup(name) != nil {
+			return true
+		}
+	}
+	return root.PersistentFlags().Lookup(name) != nil
+}
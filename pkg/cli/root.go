@@ -19,15 +19,18 @@ var rootCmd = &cobra.Command{
 	Use:          "mallet",
 	SilenceUsage: true,
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		// the config file may set log-level, and its error is logged after the logger is set up
+		configErr := loadConfig(cmd)
 		if err := setupLogger(); err != nil {
 			return err
 		}
-		return nil
+		return configErr
 	},
 }
 
 func init() {
 	rootCmd.PersistentFlags().StringVarP(&rootFlags.logLevel, "log-level", "", "info", "log level (one of debug, info, warn and error)")
+	rootCmd.PersistentFlags().StringVarP(&rootFlags.configPath, "config", "", "", "path to a YAML config file")
 }
 
 func Execute() {
@@ -0,0 +1,63 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+
+	natpkg "github.com/ryotarai/mallet/pkg/nat"
+	"github.com/ryotarai/mallet/pkg/resolver"
+	"github.com/ryotarai/mallet/pkg/route"
+	"github.com/spf13/cobra"
+)
+
+// newRulesCommand returns rules command, which is the same as start command with --dry-run
+func newRulesCommand(start *cobra.Command) *cobra.Command {
+	c := &cobra.Command{
+		Use: "rules [flags] TARGET...",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			startFlags.dryRun = true
+			return start.RunE(cmd, args)
+		},
+	}
+	c.Flags().AddFlagSet(start.Flags())
+	c.Flags().MarkHidden("dry-run")
+
+	return c
+}
+
+// printRules prints commands which start command would run to redirect targets, without running them.
+// Hostnames are resolved once with the local name servers, so that tunnels are not connected.
+func printRules(w io.Writer, targets []resolver.Target, listenPort int, udpPort int) error {
+	if startFlags.remoteDNS != "" {
+		warnRemoteDNS(defaultTunnelName)
+	}
+	for _, t := range loadedConfig.Tunnels {
+		if t.RemoteDNS != "" {
+			warnRemoteDNS(t.Name)
+		}
+	}
+
+	fmt.Fprintf(w, "# Names containing the process ID and ports chosen automatically differ on each start\n")
+
+	nat, err := natpkg.New(logger, listenPort, udpPort, startFlags.tproxy, startFlags.natBackend, natpkg.NewDryRunExecutor(w))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\n# Setup\n")
+	if err := nat.Setup(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\n# Redirect subnets\n")
+	r := resolver.New(logger, nat, route.NewTable(), startFlags.excludeSubnets, nil, resolver.TTLConfig{
+		MinTTL:    startFlags.dnsMinTTL,
+		MaxTTL:    startFlags.dnsMaxTTL,
+		Retention: startFlags.ipRetention,
+	}, nil)
+	return r.ResolveOnce(targets)
+}
+
+func warnRemoteDNS(tunnelName string) {
+	logger.Warn().Str("tunnel", tunnelName).Msg("Hostnames are resolved with the local name servers instead of the remote DNS server in dry run")
+}
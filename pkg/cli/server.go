@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ryotarai/mallet/pkg/route"
+	"github.com/ryotarai/mallet/pkg/server"
+	"github.com/spf13/cobra"
+)
+
+var serverFlags struct {
+	listen       string
+	keyFile      string
+	authFile     string
+	auth         string
+	allowSubnets []string
+}
+
+func init() {
+	c := &cobra.Command{
+		Use: "server",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var allowSubnets []*net.IPNet
+			for _, s := range serverFlags.allowSubnets {
+				subnet, err := route.ParseSubnet(s)
+				if err != nil {
+					return err
+				}
+				allowSubnets = append(allowSubnets, subnet)
+			}
+
+			srv, err := server.New(logger, server.Config{
+				KeyFile:      serverFlags.keyFile,
+				AuthFile:     serverFlags.authFile,
+				Auth:         serverFlags.auth,
+				AllowSubnets: allowSubnets,
+			})
+			if err != nil {
+				return err
+			}
+
+			sigCh := make(chan os.Signal, 1)
+			signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+			if err := srv.Start(serverFlags.listen); err != nil {
+				return err
+			}
+
+			<-sigCh
+
+			logger.Info().Msg("Shutting down")
+			return srv.Stop()
+		},
+	}
+
+	c.Flags().StringVar(&serverFlags.listen, "listen", "0.0.0.0:8080", "address to listen on")
+	c.Flags().StringVar(&serverFlags.keyFile, "key-file", "", "path of the private key, generated if it does not exist so that the fingerprint is kept across restarts (empty to generate a new key on every start)")
+	c.Flags().StringVar(&serverFlags.authFile, "authfile", "", "users file in the format of chisel server (JSON of \"user:pass\" to address regexps)")
+	c.Flags().StringVar(&serverFlags.auth, "auth", "", "user:pass allowed to connect (to any destination allowed by --allow-subnet)")
+	c.Flags().StringSliceVar(&serverFlags.allowSubnets, "allow-subnet", nil, "subnets clients are allowed to connect to (default to any)")
+
+	rootCmd.AddCommand(c)
+}
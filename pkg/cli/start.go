@@ -1,28 +1,66 @@
 package cli
 
 import (
-	chclient "github.com/jpillora/chisel/client"
+	"context"
+	"fmt"
 	"net"
-	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	"github.com/ryotarai/mallet/pkg/nat"
+	"github.com/ryotarai/mallet/pkg/control"
+	"github.com/ryotarai/mallet/pkg/dnsforwarder"
+	"github.com/ryotarai/mallet/pkg/metrics"
+	natpkg "github.com/ryotarai/mallet/pkg/nat"
 	"github.com/ryotarai/mallet/pkg/proxy"
 	"github.com/ryotarai/mallet/pkg/resolver"
+	"github.com/ryotarai/mallet/pkg/route"
+	"github.com/ryotarai/mallet/pkg/state"
+	"github.com/ryotarai/mallet/pkg/tunnel"
 	"github.com/spf13/cobra"
 )
 
 var startFlags struct {
 	chiselServer     string
 	listenPort       int
-	listenHost       string
+	listenHosts      []string
 	dnsCheckInterval time.Duration
 	excludeSubnets   []string
+	natBackend       string
+	controlSocket    string
+	metricsListen    string
+	redirect         bool
+	socksListen      string
+	socksAuth        string
+	httpListen       string
+	proxyDirect      bool
+	dnsListen        string
+	dnsUpstreams     []string
+	remoteDNS        string
+	dnsMinTTL        time.Duration
+	dnsMaxTTL        time.Duration
+	ipRetention      time.Duration
+	udp              bool
+	tproxy           bool
+	udpIdleTimeout   time.Duration
+	dryRun           bool
+	stateDir         string
+	natVerify        time.Duration
+	drainTimeout     time.Duration
+	idleTimeout      time.Duration
+	maxLifetime      time.Duration
+	tcpKeepalive     time.Duration
+	connectTimeout   time.Duration
+	routePolicy      string
+
+	ssh                string
+	sshIdentityFiles   []string
+	sshKnownHostsFiles []string
+	sshKeepalive       time.Duration
 
 	chiselFingerprint      string
 	chiselAuth             string
@@ -35,14 +73,55 @@ var startFlags struct {
 
 func init() {
 	c := &cobra.Command{
-		Use:  "start",
-		Args: cobra.MinimumNArgs(1),
+		Use: "start [flags] TARGET...",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			logger.Debug().Strs("args", args).Msgf("Starting")
 
+			targets := args
+			if len(targets) == 0 {
+				targets = loadedConfig.Targets
+			}
+
+			// tunnels are not built in dry run, so that it works without their flags
+			var tunnels map[string]tunnel.Tunnel
+			var remoteDNS map[string]*tunnel.RemoteDNS
+			resolverTargets := buildTargets(targets)
+			if startFlags.dryRun {
+				if len(resolverTargets) == 0 {
+					return fmt.Errorf("no target is specified in arguments or config file")
+				}
+			} else {
+				var err error
+				tunnels, resolverTargets, remoteDNS, err = buildTunnels(targets)
+				if err != nil {
+					return err
+				}
+			}
+			policies, err := buildPolicies()
+			if err != nil {
+				return err
+			}
+
+			if !startFlags.redirect && startFlags.socksListen == "" && startFlags.httpListen == "" {
+				return fmt.Errorf("--socks-listen or --http-listen is required when --redirect=false")
+			}
+
+			if startFlags.udp && startFlags.udpIdleTimeout <= 0 {
+				return fmt.Errorf("--udp-idle-timeout must be positive")
+			}
+
+			socksAuth, err := buildSOCKSAuth(cmd)
+			if err != nil {
+				return err
+			}
+
+			if startFlags.dryRun && !startFlags.redirect {
+				return fmt.Errorf("no rules are applied when --redirect=false")
+			}
+
 			// check user is root
-			if os.Getegid() != 0 {
-				logger.Warn().Msg("Mallet requires root privilege to redirect packets")
+			if startFlags.redirect && !startFlags.dryRun && os.Geteuid() != 0 {
+				logger.Warn().Msg("Mallet requires root privilege to redirect packets (use --redirect=false with --socks-listen or --http-listen to run without it)")
 			}
 
 			// find port
@@ -55,51 +134,204 @@ func init() {
 				listenPort = port
 			}
 
-			sigCh := make(chan os.Signal)
+			udpPort := 0
+			if startFlags.udp && startFlags.redirect {
+				port, err := findFreeUDPPort()
+				if err != nil {
+					return err
+				}
+				udpPort = port
+			}
+
+			if startFlags.dryRun {
+				return printRules(os.Stdout, resolverTargets, listenPort, udpPort)
+			}
+
+			sigCh := make(chan os.Signal, 1)
 			signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
 			exitCh := make(chan struct{})
+			var exitOnce sync.Once
+			exit := func() {
+				exitOnce.Do(func() { close(exitCh) })
+			}
 
-			nat, err := nat.New(logger, listenPort)
-			if err != nil {
-				return err
+			var nat natpkg.NAT
+			var st *state.State
+			var watchdog *natpkg.Watchdog
+			if startFlags.redirect {
+				backend, err := natpkg.ResolveBackend(startFlags.natBackend)
+				if err != nil {
+					return err
+				}
+				if !natpkg.SupportsBypass(backend) {
+					for name, policy := range policies {
+						if policy != proxy.PolicyTunnel {
+							return fmt.Errorf("route-policy %s of tunnel %s is not supported with %s backend, since direct connections to redirected subnets are redirected again", policy, name, backend)
+						}
+					}
+				}
+
+				nat, err = natpkg.New(logger, listenPort, udpPort, startFlags.tproxy, backend, natpkg.CommandExecutor{})
+				if err != nil {
+					return err
+				}
+
+				// delete rules left by processes which did not shutdown properly
+				if err := cleanupStates(startFlags.stateDir, false, 0); err != nil {
+					return err
+				}
+
+				// the state is written before Setup so that rules are deleted by cleanup even if it fails halfway
+				st, err = state.New(backend, nat.RuleSets())
+				if err != nil {
+					return err
+				}
+				if err := state.Write(startFlags.stateDir, st); err != nil {
+					return fmt.Errorf("failed to write the state file: %w", err)
+				}
+
+				if err := nat.Setup(); err != nil {
+					return err
+				}
+
+				if startFlags.natVerify > 0 {
+					watchdog = natpkg.NewWatchdog(logger, nat)
+					nat = watchdog
+					go watchdog.Start(startFlags.natVerify)
+				}
+
+				// rules are removed on shutdown, and also when the rest of startup fails
+				defer func() {
+					if watchdog != nil {
+						watchdog.Stop()
+					}
+					if err := nat.Shutdown(); err != nil {
+						logger.Warn().Err(err).Msg("Failed to shutdown NAT (the state file is kept for mallet cleanup)")
+					} else if err := state.Remove(startFlags.stateDir, st.PID); err != nil {
+						logger.Warn().Err(err).Msg("Failed to remove the state file")
+					}
+				}()
 			}
 
-			if err := nat.Cleanup(); err != nil {
-				return err
+			routes := route.NewTable()
+
+			lookupers := map[string]resolver.Exchanger{}
+			exchangers := map[string]dnsforwarder.Exchanger{}
+			for name, d := range remoteDNS {
+				logger.Info().Str("tunnel", name).Msgf("Resolving hostnames with %s via the tunnel", d.Server())
+				lookupers[name] = d
+				exchangers[name] = d
 			}
 
-			if err := nat.Setup(); err != nil {
+			prx := proxy.New(logger, nat, tunnels, routes, buildTimeouts(), policies)
+
+			ttl := resolver.TTLConfig{
+				MinTTL:    startFlags.dnsMinTTL,
+				MaxTTL:    startFlags.dnsMaxTTL,
+				Retention: startFlags.ipRetention,
+			}
+			resolver := resolver.New(logger, nat, routes, startFlags.excludeSubnets, lookupers, ttl, prx)
+
+			if err := prx.StartTunnels(); err != nil {
+				// close tunnels which have been started
+				prx.Shutdown(context.Background())
 				return err
 			}
 
-			resolver := resolver.New(logger, nat, startFlags.excludeSubnets)
+			// hostnames may be resolved via tunnels, so the resolver is started after them
 			go func() {
-				resolver.Start(startFlags.dnsCheckInterval, args)
+				resolver.Start(startFlags.dnsCheckInterval, resolverTargets)
 			}()
 
-			chiselHeaders := http.Header{}
-			if startFlags.chiselHostname != "" {
-				chiselHeaders["Host"] = []string{startFlags.chiselHostname}
+			// stopResolving stops the resolver and tunnels when the rest of startup fails
+			stopResolving := func() {
+				resolver.Stop()
+				prx.Shutdown(context.Background())
 			}
-			chiselConfig := &chclient.Config{
-				Fingerprint:      startFlags.chiselFingerprint,
-				Auth:             startFlags.chiselAuth,
-				KeepAlive:        startFlags.chiselKeepalive,
-				MaxRetryCount:    startFlags.chiselMaxRetryCount,
-				MaxRetryInterval: startFlags.chiselMaxRetryInterval,
-				Server:           startFlags.chiselServer,
-				Proxy:            startFlags.chiselProxy,
-				Headers:          chiselHeaders,
+
+			var forwarder *dnsforwarder.Forwarder
+			var patterns []dnsforwarder.Pattern
+			for _, t := range resolverTargets {
+				if t.IsHostname() {
+					patterns = append(patterns, dnsforwarder.Pattern{Pattern: t.Address, Tunnel: t.Tunnel})
+				}
 			}
+			if startFlags.dnsListen != "" {
+				upstreams := startFlags.dnsUpstreams
+				if len(upstreams) == 0 {
+					upstreams, err = dnsforwarder.SystemUpstreams(startFlags.dnsListen)
+					if err != nil {
+						stopResolving()
+						return err
+					}
+				}
 
-			prx := proxy.New(logger, nat, chiselConfig)
-			go func() {
-				if err := prx.Start(startFlags.listenHost, listenPort); err != nil {
-					logger.Error().Err(err).Msg("")
-					close(exitCh)
+				forwarder = dnsforwarder.New(logger, resolver, patterns, upstreams, exchangers, ttl.MinTTL)
+				if err := forwarder.Start(startFlags.dnsListen); err != nil {
+					stopResolving()
+					return err
 				}
-			}()
+			} else {
+				for _, p := range patterns {
+					if strings.HasPrefix(p.Pattern, "*.") {
+						logger.Warn().Str("target", p.Pattern).Msg("Wildcard targets are redirected only with --dns-listen")
+					}
+				}
+			}
+
+			if nat != nil {
+				go func() {
+					if err := prx.Start(startFlags.listenHosts, listenPort, startFlags.tproxy); err != nil {
+						logger.Error().Err(err).Msg("")
+						exit()
+					}
+				}()
+			}
+
+			if nat != nil && udpPort > 0 {
+				go func() {
+					if err := prx.StartUDP(startFlags.listenHosts, udpPort, startFlags.udpIdleTimeout); err != nil {
+						logger.Error().Err(err).Msg("")
+						exit()
+					}
+				}()
+			}
+
+			if startFlags.socksListen != "" {
+				go func() {
+					if err := prx.StartSOCKS(startFlags.socksListen, socksAuth, startFlags.proxyDirect); err != nil {
+						logger.Error().Err(err).Msg("")
+						exit()
+					}
+				}()
+			}
+
+			if startFlags.httpListen != "" {
+				go func() {
+					if err := prx.StartHTTP(startFlags.httpListen, startFlags.proxyDirect); err != nil {
+						logger.Error().Err(err).Msg("")
+						exit()
+					}
+				}()
+			}
+
+			if startFlags.metricsListen != "" {
+				go func() {
+					if err := metrics.Serve(logger, startFlags.metricsListen); err != nil {
+						logger.Warn().Err(err).Msg("Failed to serve metrics")
+					}
+				}()
+			}
+
+			var controlServer *control.Server
+			if startFlags.controlSocket != "" {
+				controlServer = control.NewServer(logger, startFlags.controlSocket, resolver, prx)
+				if err := controlServer.Start(); err != nil {
+					logger.Warn().Err(err).Msg("Failed to start control server")
+					controlServer = nil
+				}
+			}
 
 			select {
 			case <-sigCh:
@@ -107,20 +339,73 @@ func init() {
 			}
 
 			logger.Info().Msg("Shutting down")
-			resolver.Stop()
-			if err := nat.Shutdown(); err != nil {
-				logger.Warn().Err(err).Msg("Failed to shutdown NAT")
+			ctx, cancel := context.WithTimeout(context.Background(), startFlags.drainTimeout)
+			defer cancel()
+			go func() {
+				select {
+				case <-sigCh:
+					logger.Info().Msg("Received a signal again, forcing exit")
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+
+			if controlServer != nil {
+				if err := controlServer.Stop(); err != nil {
+					logger.Warn().Err(err).Msg("Failed to stop control server")
+				}
+			}
+			if forwarder != nil {
+				if err := forwarder.Stop(); err != nil {
+					logger.Warn().Err(err).Msg("Failed to stop DNS forwarder")
+				}
 			}
+			// NAT rules are kept until listeners are closed, so that new connections are refused instead of going directly
+			if err := prx.Shutdown(ctx); err != nil {
+				logger.Warn().Err(err).Msg("Connections did not finish, closing them")
+			}
+			resolver.Stop()
 
 			return nil
 		},
 	}
-	c.Flags().StringVar(&startFlags.chiselServer, "chisel-server", "", "")
-	c.MarkFlagRequired("chisel-server")
+	c.Flags().StringVar(&startFlags.chiselServer, "chisel-server", "", "chisel server of the default tunnel (--chisel-server or --ssh is required unless tunnels are defined in config file)")
+	c.Flags().StringVar(&startFlags.ssh, "ssh", "", "SSH server ([user@]host[:port] or a host in ~/.ssh/config) of the default tunnel, used instead of chisel")
 	c.Flags().IntVar(&startFlags.listenPort, "listen-port", 0, "0 for auto")
-	c.Flags().StringVar(&startFlags.listenHost, "listen-host", "127.0.0.1", "local proxy server listens on")
-	c.Flags().DurationVar(&startFlags.dnsCheckInterval, "dns-check-interval", time.Minute*5, "")
+	c.Flags().StringSliceVar(&startFlags.listenHosts, "listen-host", []string{"127.0.0.1", "::1"}, "local proxy server listens on")
+	c.Flags().DurationVar(&startFlags.dnsCheckInterval, "dns-check-interval", time.Minute*5, "interval to resolve hostname targets whose TTL is unknown")
+	c.Flags().DurationVar(&startFlags.dnsMinTTL, "dns-min-ttl", time.Second*10, "minimum interval to resolve hostname targets, and to redirect addresses learned by the DNS forwarder, regardless of TTL")
+	c.Flags().DurationVar(&startFlags.dnsMaxTTL, "dns-max-ttl", time.Minute*5, "maximum interval to resolve hostname targets regardless of TTL")
+	c.Flags().DurationVar(&startFlags.ipRetention, "resolved-ip-retention", time.Hour, "duration to keep redirecting addresses after their TTL passes")
 	c.Flags().StringSliceVar(&startFlags.excludeSubnets, "exclude-subnet", nil, "subnets to exclude")
+	c.Flags().StringVar(&startFlags.natBackend, "nat-backend", natpkg.BackendAuto, "NAT backend (one of auto, iptables, nftables, netlink and pf)")
+	c.Flags().DurationVar(&startFlags.drainTimeout, "drain-timeout", 10*time.Second, "duration to wait for connections to finish on shutdown (signal again to exit immediately)")
+	c.Flags().DurationVar(&startFlags.natVerify, "nat-verify-interval", 30*time.Second, "interval to verify that NAT rules are in place and install them again if not (0 to disable)")
+	c.Flags().BoolVar(&startFlags.redirect, "redirect", true, "redirect packets to targets with NAT (requires root privilege)")
+	c.Flags().BoolVar(&startFlags.udp, "udp", false, "redirect UDP datagrams to targets with TPROXY (Linux only). Only DNS works unless the tunnel is connected to mallet server")
+	c.Flags().BoolVar(&startFlags.tproxy, "tproxy", false, "redirect TCP connections with TPROXY instead of REDIRECT (Linux only)")
+	c.Flags().DurationVar(&startFlags.idleTimeout, "idle-timeout", 0, "duration to keep a TCP connection without data in either direction (0 to disable)")
+	c.Flags().DurationVar(&startFlags.maxLifetime, "max-connection-lifetime", 0, "duration to keep a TCP connection since it is established (0 to disable)")
+	c.Flags().DurationVar(&startFlags.tcpKeepalive, "tcp-keepalive", 0, "interval of TCP keepalive probes on accepted connections (0 for the default, negative to disable)")
+	c.Flags().DurationVar(&startFlags.connectTimeout, "connect-timeout", 5*time.Second, "timeout to connect or check the tunnel before falling back on the other way with route-policy (0 to disable)")
+	c.Flags().StringVar(&startFlags.routePolicy, "route-policy", string(proxy.PolicyTunnel), "how connections to targets are made (one of tunnel, direct, tunnel-then-direct and direct-then-tunnel)")
+	c.Flags().DurationVar(&startFlags.udpIdleTimeout, "udp-idle-timeout", time.Minute, "duration to keep a UDP flow without datagrams")
+	c.Flags().BoolVar(&startFlags.dryRun, "dry-run", false, "print commands and rules to redirect targets without applying them or connecting tunnels")
+	c.Flags().StringVar(&startFlags.socksListen, "socks-listen", "", "address to serve SOCKS5 proxy on (e.g. 127.0.0.1:1080, empty to disable)")
+	c.Flags().StringVar(&startFlags.socksAuth, "socks-auth", "", "username and password required by SOCKS5 proxy (user:pass). Set it in config file or "+socksAuthEnv+" since command lines are visible to other users")
+	c.Flags().StringVar(&startFlags.httpListen, "http-listen", "", "address to serve HTTP proxy on (e.g. 127.0.0.1:3128, empty to disable)")
+	c.Flags().BoolVar(&startFlags.proxyDirect, "proxy-direct", false, "connect directly to destinations not routed to any tunnel via SOCKS5 and HTTP proxies, instead of rejecting them")
+	c.Flags().StringVar(&startFlags.dnsListen, "dns-listen", "", "address to serve DNS forwarder on which redirects addresses in answers for hostname and wildcard targets (e.g. 127.0.0.1:53, empty to disable)")
+	c.Flags().StringSliceVar(&startFlags.dnsUpstreams, "dns-upstream", nil, "upstream DNS servers of DNS forwarder (host:port, default to name servers in /etc/resolv.conf)")
+	c.Flags().StringVar(&startFlags.remoteDNS, "remote-dns", "", "DNS server on the remote side to resolve hostname targets of the default tunnel via the tunnel (host[:port], empty to resolve locally)")
+	c.Flags().StringVar(&startFlags.metricsListen, "metrics-listen", "", "address to serve Prometheus metrics on /metrics (e.g. 127.0.0.1:9100, empty to disable)")
+	c.Flags().StringVar(&startFlags.stateDir, "state-dir", state.DefaultDir, "directory of state files which record rules installed by each process")
+	c.Flags().StringVar(&startFlags.controlSocket, "control-socket", control.DefaultSocketPath, "path of Unix domain socket to serve status (empty to disable)")
+
+	// flags for SSH client
+	c.Flags().StringSliceVar(&startFlags.sshIdentityFiles, "ssh-identity-file", nil, "private keys used in addition to ssh-agent (default to IdentityFile in ~/.ssh/config or ~/.ssh/id_*)")
+	c.Flags().StringSliceVar(&startFlags.sshKnownHostsFiles, "ssh-known-hosts-file", nil, "known_hosts files to verify the server (default to UserKnownHostsFile in ~/.ssh/config or ~/.ssh/known_hosts)")
+	c.Flags().DurationVar(&startFlags.sshKeepalive, "ssh-keepalive", defaultSSHKeepalive, "interval to check the SSH connection and reconnect (0 to disable)")
 
 	// flags for chisel client
 	c.Flags().StringVar(&startFlags.chiselFingerprint, "chisel-fingerprint", "", "")
@@ -132,6 +417,30 @@ func init() {
 	c.Flags().StringVar(&startFlags.chiselHostname, "chisel-hostname", "", "")
 
 	rootCmd.AddCommand(c)
+	rootCmd.AddCommand(newRulesCommand(c))
+}
+
+// socksAuthEnv is the environment variable of --socks-auth, which keeps the password out of command lines
+const socksAuthEnv = "MALLET_SOCKS_AUTH"
+
+// buildSOCKSAuth returns credentials of the SOCKS5 proxy from --socks-auth (or the config file) or socksAuthEnv
+func buildSOCKSAuth(cmd *cobra.Command) (*proxy.SOCKSAuth, error) {
+	value := startFlags.socksAuth
+	if _, ok := loadedConfig.Flags["socks-auth"]; !ok && cmd.Flags().Changed("socks-auth") {
+		logger.Warn().Msgf("--socks-auth in command line is visible to other users, so set it in config file or %s instead", socksAuthEnv)
+	}
+	if value == "" {
+		value = os.Getenv(socksAuthEnv)
+	}
+	if value == "" {
+		return nil, nil
+	}
+
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("--socks-auth or %s must be in the form of user:pass", socksAuthEnv)
+	}
+	return &proxy.SOCKSAuth{Username: parts[0], Password: parts[1]}, nil
 }
 
 func findFreeTCPPort() (int, error) {
@@ -147,3 +456,16 @@ func findFreeTCPPort() (int, error) {
 	parts := strings.Split(l.Addr().String(), ":")
 	return strconv.Atoi(parts[len(parts)-1])
 }
+
+func findFreeUDPPort() (int, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+
+	if err := conn.Close(); err != nil {
+		return 0, err
+	}
+
+	return conn.LocalAddr().(*net.UDPAddr).Port, nil
+}
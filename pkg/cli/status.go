@@ -0,0 +1,80 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ryotarai/mallet/pkg/control"
+	"github.com/spf13/cobra"
+)
+
+var statusFlags struct {
+	controlSocket string
+	output        string
+}
+
+func init() {
+	c := &cobra.Command{
+		Use: "status",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			status, err := control.NewClient(statusFlags.controlSocket).Status()
+			if err != nil {
+				return fmt.Errorf("failed to get status (is mallet running?): %w", err)
+			}
+
+			switch statusFlags.output {
+			case "json":
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(status)
+			case "text":
+				return printStatus(status)
+			}
+
+			return fmt.Errorf("unknown output format: %s", statusFlags.output)
+		},
+	}
+	c.Flags().StringVar(&statusFlags.controlSocket, "control-socket", control.DefaultSocketPath, "path of Unix domain socket of running mallet process")
+	c.Flags().StringVarP(&statusFlags.output, "output", "o", "text", "output format (one of text and json)")
+
+	rootCmd.AddCommand(c)
+}
+
+func printStatus(status *control.Status) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(w, "PID:\t%d\n", status.PID)
+	fmt.Fprintf(w, "Started:\t%s (%s ago)\n", status.StartedAt.Format(time.RFC3339), time.Since(status.StartedAt).Round(time.Second))
+	fmt.Fprintf(w, "Active connections:\t%d\n", status.Proxy.ActiveConnections)
+
+	fmt.Fprintf(w, "\nTUNNEL\tCONNECTED\tCONNECTIONS\tERROR\n")
+	for _, t := range status.Tunnels {
+		fmt.Fprintf(w, "%s\t%t\t%d\t%s\n", t.Name, t.Connected, status.Proxy.ActiveConnectionsByTunnels[t.Name], t.Error)
+	}
+
+	fmt.Fprintf(w, "\nTARGET\tTUNNEL\tADDRESSES\tNEXT\tERROR\n")
+	for _, t := range status.Targets {
+		errMsg := t.Error
+		if t.Failures > 0 {
+			errMsg = fmt.Sprintf("%s (%d failures)", t.Error, t.Failures)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.Address, t.Tunnel, strings.Join(t.Addresses, ","), t.NextAt.Format(time.RFC3339), errMsg)
+	}
+
+	fmt.Fprintf(w, "\nSUBNET\tTUNNEL\tEXPIRES\n")
+	for _, s := range status.Subnets {
+		expires := "-"
+		if s.Pinned {
+			expires = "pinned by connections"
+		} else if !s.ExpireAt.IsZero() {
+			expires = s.ExpireAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", s.Subnet, s.Tunnel, expires)
+	}
+
+	return w.Flush()
+}
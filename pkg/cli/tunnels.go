@@ -0,0 +1,186 @@
+package cli
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ryotarai/mallet/pkg/config"
+	"github.com/ryotarai/mallet/pkg/proxy"
+	"github.com/ryotarai/mallet/pkg/resolver"
+	"github.com/ryotarai/mallet/pkg/route"
+	"github.com/ryotarai/mallet/pkg/tunnel"
+)
+
+// defaultTunnelName is the name of the tunnel configured by command line flags
+const defaultTunnelName = config.DefaultTunnel
+
+// buildTunnels returns tunnels and their targets configured by flags and the config file.
+// Remote DNS servers are keyed by tunnel name too.
+func buildTunnels(targets []string) (map[string]tunnel.Tunnel, []resolver.Target, map[string]*tunnel.RemoteDNS, error) {
+	tunnels := map[string]tunnel.Tunnel{}
+	remoteDNS := map[string]*tunnel.RemoteDNS{}
+
+	if startFlags.chiselServer != "" || startFlags.ssh != "" {
+		if len(targets) == 0 {
+			return nil, nil, nil, fmt.Errorf("no target is specified in arguments or config file")
+		}
+		if startFlags.chiselServer != "" && startFlags.ssh != "" {
+			return nil, nil, nil, fmt.Errorf("only one of --chisel-server and --ssh can be specified")
+		}
+
+		maxRetryCount := startFlags.chiselMaxRetryCount
+		sshKeepalive := startFlags.sshKeepalive
+		tunnels[defaultTunnelName] = newTunnel(defaultTunnelName, config.Tunnel{
+			SSH:                    startFlags.ssh,
+			SSHIdentityFiles:       startFlags.sshIdentityFiles,
+			SSHKnownHostsFiles:     startFlags.sshKnownHostsFiles,
+			SSHKeepalive:           &sshKeepalive,
+			ChiselServer:           startFlags.chiselServer,
+			ChiselFingerprint:      startFlags.chiselFingerprint,
+			ChiselAuth:             startFlags.chiselAuth,
+			ChiselKeepalive:        startFlags.chiselKeepalive,
+			ChiselMaxRetryCount:    &maxRetryCount,
+			ChiselMaxRetryInterval: startFlags.chiselMaxRetryInterval,
+			ChiselProxy:            startFlags.chiselProxy,
+			ChiselHostname:         startFlags.chiselHostname,
+		})
+		if startFlags.remoteDNS != "" {
+			remoteDNS[defaultTunnelName] = tunnel.NewRemoteDNS(tunnels[defaultTunnelName], startFlags.remoteDNS)
+		}
+	} else if len(targets) > 0 {
+		return nil, nil, nil, fmt.Errorf("--chisel-server or --ssh is required for targets in arguments")
+	}
+
+	for _, t := range loadedConfig.Tunnels {
+		if _, ok := tunnels[t.Name]; ok {
+			return nil, nil, nil, fmt.Errorf("tunnel %s is defined twice", t.Name)
+		}
+		tunnels[t.Name] = newTunnel(t.Name, t)
+		if t.RemoteDNS != "" {
+			remoteDNS[t.Name] = tunnel.NewRemoteDNS(tunnels[t.Name], t.RemoteDNS)
+		}
+	}
+
+	if len(tunnels) == 0 {
+		return nil, nil, nil, fmt.Errorf("--chisel-server, --ssh or tunnels in config file is required")
+	}
+
+	return tunnels, buildTargets(targets), remoteDNS, nil
+}
+
+// buildTargets returns targets in arguments for the default tunnel and ones of tunnels in config file,
+// without building the tunnels
+func buildTargets(targets []string) []resolver.Target {
+	var resolverTargets []resolver.Target
+	for _, target := range targets {
+		resolverTargets = append(resolverTargets, resolver.Target{Address: target, Tunnel: defaultTunnelName})
+	}
+	for _, t := range loadedConfig.Tunnels {
+		for _, target := range t.Targets {
+			resolverTargets = append(resolverTargets, resolver.Target{Address: target, Tunnel: t.Name})
+		}
+	}
+	return resolverTargets
+}
+
+// buildTimeouts returns timeouts of connections keyed by tunnel name.
+// Flags apply to the default tunnel and direct connections, and are overridden by each tunnel in config file.
+func buildTimeouts() map[string]proxy.Timeouts {
+	defaults := proxy.Timeouts{
+		Idle:      startFlags.idleTimeout,
+		Lifetime:  startFlags.maxLifetime,
+		Keepalive: startFlags.tcpKeepalive,
+		Connect:   startFlags.connectTimeout,
+	}
+
+	timeouts := map[string]proxy.Timeouts{
+		defaultTunnelName: defaults,
+		route.Direct:      defaults,
+	}
+	for _, t := range loadedConfig.Tunnels {
+		tt := defaults
+		if t.IdleTimeout != nil {
+			tt.Idle = *t.IdleTimeout
+		}
+		if t.MaxLifetime != nil {
+			tt.Lifetime = *t.MaxLifetime
+		}
+		if t.TCPKeepalive != nil {
+			tt.Keepalive = *t.TCPKeepalive
+		}
+		if t.ConnectTimeout != nil {
+			tt.Connect = *t.ConnectTimeout
+		}
+		timeouts[t.Name] = tt
+	}
+
+	return timeouts
+}
+
+// buildPolicies returns route policies keyed by tunnel name.
+// The flag applies to the default tunnel, and is overridden by each tunnel in config file.
+func buildPolicies() (map[string]proxy.Policy, error) {
+	policies := map[string]proxy.Policy{}
+
+	defaultPolicy, err := proxy.ParsePolicy(startFlags.routePolicy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --route-policy: %w", err)
+	}
+	policies[defaultTunnelName] = defaultPolicy
+
+	for _, t := range loadedConfig.Tunnels {
+		if t.RoutePolicy == "" {
+			policies[t.Name] = defaultPolicy
+			continue
+		}
+		policy, err := proxy.ParsePolicy(t.RoutePolicy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route-policy of tunnel %s: %w", t.Name, err)
+		}
+		policies[t.Name] = policy
+	}
+
+	return policies, nil
+}
+
+// defaultSSHKeepalive is the keepalive interval of SSH tunnels unless specified
+const defaultSSHKeepalive = 30 * time.Second
+
+func newTunnel(name string, t config.Tunnel) tunnel.Tunnel {
+	if t.SSH != "" {
+		return newSSHTunnel(name, t)
+	}
+	return newChiselTunnel(name, t)
+}
+
+func newSSHTunnel(name string, t config.Tunnel) *tunnel.SSH {
+	keepalive := defaultSSHKeepalive
+	if t.SSHKeepalive != nil {
+		keepalive = *t.SSHKeepalive
+	}
+
+	return tunnel.NewSSH(logger.With().Str("tunnel", name).Logger(), tunnel.SSHConfig{
+		Destination:     t.SSH,
+		IdentityFiles:   t.SSHIdentityFiles,
+		KnownHostsFiles: t.SSHKnownHostsFiles,
+		Keepalive:       keepalive,
+	})
+}
+
+func newChiselTunnel(name string, t config.Tunnel) *tunnel.Chisel {
+	maxRetryCount := -1
+	if t.ChiselMaxRetryCount != nil {
+		maxRetryCount = *t.ChiselMaxRetryCount
+	}
+
+	return tunnel.NewChisel(logger.With().Str("tunnel", name).Logger(), tunnel.ChiselConfig{
+		Server:           t.ChiselServer,
+		Fingerprint:      t.ChiselFingerprint,
+		Auth:             t.ChiselAuth,
+		Keepalive:        t.ChiselKeepalive,
+		MaxRetryCount:    maxRetryCount,
+		MaxRetryInterval: t.ChiselMaxRetryInterval,
+		Proxy:            t.ChiselProxy,
+		Hostname:         t.ChiselHostname,
+	})
+}
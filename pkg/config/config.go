@@ -0,0 +1,102 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/ryotarai/mallet/pkg/route"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultTunnel is the reserved name of the tunnel configured by command line flags and top-level options
+const DefaultTunnel = "default"
+
+// Config is the content of a config file.
+//
+// Example:
+//
+//	chisel-server: http://a.example.com:8080
+//	chisel-auth: user:pass
+//	exclude-subnet:
+//	  - 10.0.1.0/24
+//	targets:
+//	  - 10.0.0.0/8
+//	  - db.example.com
+//	tunnels:
+//	  - name: vpc-b
+//	    chisel-server: http://b.example.com:8080
+//	    targets:
+//	      - 172.16.0.0/12
+//	  - name: vpc-c
+//	    ssh: user@bastion.c.example.com
+//	    targets:
+//	      - 192.168.0.0/16
+type Config struct {
+	// Targets are subnets and hostnames to be redirected (same as arguments of start command)
+	Targets []string `yaml:"targets"`
+	// Tunnels are additional tunnels with their own targets
+	Tunnels []Tunnel `yaml:"tunnels"`
+	// Flags holds values of command line flags keyed by flag name
+	Flags map[string]interface{} `yaml:",inline"`
+}
+
+// Tunnel is a chisel or SSH connection and targets routed to it.
+// Keys are the same as flags of start command.
+type Tunnel struct {
+	Name                   string         `yaml:"name"`
+	SSH                    string         `yaml:"ssh"`
+	SSHIdentityFiles       []string       `yaml:"ssh-identity-file"`
+	SSHKnownHostsFiles     []string       `yaml:"ssh-known-hosts-file"`
+	SSHKeepalive           *time.Duration `yaml:"ssh-keepalive"`
+	ChiselServer           string         `yaml:"chisel-server"`
+	ChiselFingerprint      string         `yaml:"chisel-fingerprint"`
+	ChiselAuth             string         `yaml:"chisel-auth"`
+	ChiselKeepalive        time.Duration  `yaml:"chisel-keepalive"`
+	ChiselMaxRetryCount    *int           `yaml:"chisel-max-retry-count"`
+	ChiselMaxRetryInterval time.Duration  `yaml:"chisel-max-retry-interval"`
+	ChiselProxy            string         `yaml:"chisel-proxy"`
+	ChiselHostname         string         `yaml:"chisel-hostname"`
+	RemoteDNS              string         `yaml:"remote-dns"`
+	IdleTimeout            *time.Duration `yaml:"idle-timeout"`
+	MaxLifetime            *time.Duration `yaml:"max-connection-lifetime"`
+	TCPKeepalive           *time.Duration `yaml:"tcp-keepalive"`
+	ConnectTimeout         *time.Duration `yaml:"connect-timeout"`
+	RoutePolicy            string         `yaml:"route-policy"`
+	Targets                []string       `yaml:"targets"`
+}
+
+func Load(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	names := map[string]struct{}{}
+	for i, t := range c.Tunnels {
+		if t.Name == "" {
+			return nil, fmt.Errorf("name of tunnels[%d] is empty", i)
+		}
+		if t.Name == route.Direct || t.Name == DefaultTunnel {
+			return nil, fmt.Errorf("tunnel name %s is reserved", t.Name)
+		}
+		if _, ok := names[t.Name]; ok {
+			return nil, fmt.Errorf("tunnel %s is defined twice", t.Name)
+		}
+		names[t.Name] = struct{}{}
+
+		if t.ChiselServer == "" && t.SSH == "" {
+			return nil, fmt.Errorf("chisel-server or ssh of tunnel %s is required", t.Name)
+		}
+		if t.ChiselServer != "" && t.SSH != "" {
+			return nil, fmt.Errorf("only one of chisel-server and ssh of tunnel %s can be specified", t.Name)
+		}
+	}
+
+	return c, nil
+}
@@ -0,0 +1,20 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadReservedTunnelNames(t *testing.T) {
+	for _, name := range []string{"direct", "default"} {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		content := "tunnels:\n  - name: " + name + "\n    ssh: bastion\n"
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); err == nil {
+			t.Errorf("tunnel named %s is accepted", name)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Client requests a running mallet process via the control socket
+type Client struct {
+	http *http.Client
+}
+
+func NewClient(path string) *Client {
+	return &Client{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+func (c *Client) Status() (*Status, error) {
+	// host is ignored because the connection is made to the socket
+	resp, err := c.http.Get("http://mallet/status")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("control server responded %s", resp.Status)
+	}
+
+	status := &Status{}
+	if err := json.NewDecoder(resp.Body).Decode(status); err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
@@ -0,0 +1,27 @@
+package control
+
+import (
+	"time"
+
+	"github.com/ryotarai/mallet/pkg/proxy"
+	"github.com/ryotarai/mallet/pkg/resolver"
+)
+
+// DefaultSocketPath is the path of the control socket used unless specified
+const DefaultSocketPath = "/var/run/mallet.sock"
+
+// Status is the state of a running mallet process
+type Status struct {
+	PID       int                     `json:"pid"`
+	StartedAt time.Time               `json:"startedAt"`
+	Tunnels   []TunnelStatus          `json:"tunnels"`
+	Targets   []resolver.TargetStatus `json:"targets"`
+	Subnets   []resolver.SubnetStatus `json:"subnets"`
+	Proxy     proxy.Stats             `json:"proxy"`
+}
+
+type TunnelStatus struct {
+	Name      string `json:"name"`
+	Connected bool   `json:"connected"`
+	Error     string `json:"error,omitempty"`
+}
@@ -0,0 +1,140 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/ryotarai/mallet/pkg/proxy"
+	"github.com/ryotarai/mallet/pkg/resolver"
+)
+
+const tunnelCheckTimeout = 3 * time.Second
+
+// Server serves the status of the running process over a Unix domain socket
+type Server struct {
+	logger    zerolog.Logger
+	path      string
+	resolver  *resolver.Resolver
+	proxy     *proxy.Proxy
+	startedAt time.Time
+	server    *http.Server
+}
+
+func NewServer(logger zerolog.Logger, path string, resolver *resolver.Resolver, proxy *proxy.Proxy) *Server {
+	return &Server{
+		logger:    logger.With().Str("component", "control").Logger(),
+		path:      path,
+		resolver:  resolver,
+		proxy:     proxy,
+		startedAt: time.Now(),
+	}
+}
+
+// Start listens on the socket and serves requests in background
+func (s *Server) Start() error {
+	if err := s.removeStaleSocket(); err != nil {
+		return err
+	}
+
+	l, err := net.Listen("unix", s.path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.path, err)
+	}
+	if err := os.Chmod(s.path, 0600); err != nil {
+		l.Close()
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.handleStatus)
+	s.server = &http.Server{Handler: mux}
+
+	go func() {
+		if err := s.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			s.logger.Warn().Err(err).Msg("Control server stopped")
+		}
+	}()
+
+	s.logger.Info().Msgf("Control socket is listening on %s", s.path)
+
+	return nil
+}
+
+func (s *Server) Stop() error {
+	if s.server == nil {
+		return nil
+	}
+	// Close removes the socket file too
+	return s.server.Close()
+}
+
+// removeStaleSocket removes the socket file left by a process killed forcibly
+func (s *Server) removeStaleSocket() error {
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		return nil
+	}
+
+	if conn, err := net.Dial("unix", s.path); err == nil {
+		conn.Close()
+		return fmt.Errorf("another mallet process is listening on %s", s.path)
+	}
+
+	return os.Remove(s.path)
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status := s.status(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		s.logger.Warn().Err(err).Msg("Failed to write status")
+	}
+}
+
+func (s *Server) status(ctx context.Context) *Status {
+	status := &Status{
+		PID:       os.Getpid(),
+		StartedAt: s.startedAt,
+		Targets:   s.resolver.TargetStatus(),
+		Subnets:   s.resolver.Status(),
+		Proxy:     s.proxy.Stats(),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, tunnelCheckTimeout)
+	defer cancel()
+
+	// check tunnels concurrently not to wait for timeouts one by one
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, t := range s.proxy.Tunnels() {
+		wg.Add(1)
+		go func(name string, check func(context.Context) error) {
+			defer wg.Done()
+
+			ts := TunnelStatus{Name: name, Connected: true}
+			if err := check(ctx); err != nil {
+				ts.Connected = false
+				ts.Error = err.Error()
+			}
+
+			mu.Lock()
+			status.Tunnels = append(status.Tunnels, ts)
+			mu.Unlock()
+		}(name, t.Check)
+	}
+	wg.Wait()
+
+	sort.Slice(status.Tunnels, func(i, j int) bool {
+		return status.Tunnels[i].Name < status.Tunnels[j].Name
+	})
+
+	return status
+}
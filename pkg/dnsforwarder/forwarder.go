@@ -0,0 +1,273 @@
+package dnsforwarder
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
+	"github.com/ryotarai/mallet/pkg/route"
+)
+
+const upstreamTimeout = 5 * time.Second
+
+// Learner redirects addresses in DNS answers
+type Learner interface {
+	Learn(tunnel string, ips []net.IP, ttl time.Duration) error
+}
+
+// Exchanger sends queries to a DNS server on the remote side of a tunnel
+type Exchanger interface {
+	Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
+}
+
+// Pattern is a hostname whose addresses are redirected to the tunnel.
+// A pattern "*.example.com" matches any subdomain of example.com.
+type Pattern struct {
+	Pattern string
+	Tunnel  string
+}
+
+// Forwarder is a DNS server that forwards queries to upstream servers and
+// learns addresses in answers for names matching patterns
+type Forwarder struct {
+	logger    zerolog.Logger
+	learner   Learner
+	patterns  []Pattern
+	upstreams []string
+	remotes   map[string]Exchanger
+	minTTL    time.Duration
+	servers   []*dns.Server
+}
+
+// New returns a Forwarder. Queries for names routed to a tunnel in remotes are sent via the tunnel instead of upstreams.
+// Learned addresses are redirected for at least minTTL, since clients may keep using them a little longer than the record TTL.
+func New(logger zerolog.Logger, learner Learner, patterns []Pattern, upstreams []string, remotes map[string]Exchanger, minTTL time.Duration) *Forwarder {
+	sorted := make([]Pattern, len(patterns))
+	copy(sorted, patterns)
+	// exact names first, then longer (more specific) wildcards
+	sort.SliceStable(sorted, func(i, j int) bool {
+		wi, wj := isWildcard(sorted[i].Pattern), isWildcard(sorted[j].Pattern)
+		if wi != wj {
+			return !wi
+		}
+		return len(sorted[i].Pattern) > len(sorted[j].Pattern)
+	})
+
+	return &Forwarder{
+		logger:    logger.With().Str("component", "dns").Logger(),
+		learner:   learner,
+		patterns:  sorted,
+		upstreams: upstreams,
+		remotes:   remotes,
+		minTTL:    minTTL,
+	}
+}
+
+// SystemUpstreams returns name servers in /etc/resolv.conf except the forwarder listening on listen,
+// to avoid forwarding queries to itself when the system is pointed at the forwarder
+func SystemUpstreams(listen string) ([]string, error) {
+	conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read /etc/resolv.conf: %w", err)
+	}
+
+	var localIPs []net.IP
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get interface addresses: %w", err)
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			localIPs = append(localIPs, ipnet.IP)
+		}
+	}
+
+	return excludeListener(conf.Servers, conf.Port, listen, localIPs), nil
+}
+
+// excludeListener returns servers with port except ones where listen is.
+// If the host of listen is unspecified, the forwarder is on loopback and all of localIPs.
+func excludeListener(servers []string, port string, listen string, localIPs []net.IP) []string {
+	listenHost, listenPort, err := net.SplitHostPort(listen)
+	if err != nil {
+		listenHost, listenPort = listen, ""
+	}
+	listenIP := net.ParseIP(listenHost)
+	unspecified := listenHost == "" || (listenIP != nil && listenIP.IsUnspecified())
+
+	var upstreams []string
+	for _, server := range servers {
+		ip := net.ParseIP(server)
+		if port == listenPort && ip != nil {
+			if unspecified && (ip.IsLoopback() || containsIP(localIPs, ip)) {
+				continue
+			}
+			if ip.Equal(listenIP) {
+				continue
+			}
+		}
+		upstreams = append(upstreams, net.JoinHostPort(server, port))
+	}
+	return upstreams
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Start listens on addr with UDP and TCP and serves queries in background
+func (f *Forwarder) Start(addr string) error {
+	if len(f.upstreams) == 0 {
+		return fmt.Errorf("no upstream DNS server")
+	}
+
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on udp %s: %w", addr, err)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return fmt.Errorf("failed to listen on tcp %s: %w", addr, err)
+	}
+
+	f.servers = []*dns.Server{
+		{PacketConn: pc, Net: "udp", Handler: f},
+		{Listener: l, Net: "tcp", Handler: f},
+	}
+	for _, server := range f.servers {
+		server := server
+		go func() {
+			if err := server.ActivateAndServe(); err != nil {
+				f.logger.Warn().Err(err).Str("net", server.Net).Msg("DNS forwarder stopped")
+			}
+		}()
+	}
+
+	f.logger.Info().Strs("upstreams", f.upstreams).Msgf("DNS forwarder is listening on %s", addr)
+
+	return nil
+}
+
+func (f *Forwarder) Stop() error {
+	for _, server := range f.servers {
+		if err := server.Shutdown(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeDNS implements dns.Handler
+func (f *Forwarder) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	network := "udp"
+	if _, ok := w.LocalAddr().(*net.TCPAddr); ok {
+		network = "tcp"
+	}
+
+	tunnel, matched := "", false
+	if len(req.Question) > 0 {
+		tunnel, matched = f.match(req.Question[0].Name)
+	}
+
+	var resp *dns.Msg
+	var err error
+	if remote, ok := f.remotes[tunnel]; matched && ok {
+		resp, err = remote.Exchange(context.Background(), req)
+		if err == nil && network == "udp" {
+			// the remote server is queried over TCP and the response may not fit in a UDP message
+			size := dns.MinMsgSize
+			if opt := req.IsEdns0(); opt != nil {
+				size = int(opt.UDPSize())
+			}
+			resp.Truncate(size)
+		}
+	} else {
+		resp, err = f.forward(network, req)
+	}
+	if err != nil {
+		f.logger.Warn().Err(err).Msg("Failed to forward DNS query")
+		resp = new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+	} else if matched {
+		// learn before replying so that the client never connects to an address not redirected yet
+		f.learn(tunnel, req.Question[0].Name, resp)
+	}
+
+	if err := w.WriteMsg(resp); err != nil {
+		f.logger.Debug().Err(err).Msg("Failed to write DNS response")
+	}
+}
+
+func (f *Forwarder) forward(network string, req *dns.Msg) (*dns.Msg, error) {
+	client := &dns.Client{Net: network, Timeout: upstreamTimeout}
+
+	var lastErr error
+	for _, upstream := range f.upstreams {
+		resp, _, err := client.Exchange(req, upstream)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return resp, nil
+	}
+
+	return nil, lastErr
+}
+
+func (f *Forwarder) learn(tunnel string, name string, resp *dns.Msg) {
+	// answers may contain CNAME records followed by addresses of the canonical name
+	var ips []net.IP
+	var ttl uint32
+	for _, rr := range resp.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if len(ips) == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) == 0 {
+		return
+	}
+
+	d := time.Duration(ttl) * time.Second
+	if d < f.minTTL {
+		d = f.minTTL
+	}
+
+	f.logger.Debug().Str("name", name).Interface("ips", ips).Dur("ttl", d).Msg("Learning addresses")
+	if err := f.learner.Learn(tunnel, ips, d); err != nil {
+		f.logger.Warn().Err(err).Str("name", name).Msg("Failed to redirect learned addresses")
+	}
+}
+
+func (f *Forwarder) match(name string) (string, bool) {
+	for _, p := range f.patterns {
+		if route.MatchHost(p.Pattern, name) {
+			return p.Tunnel, true
+		}
+	}
+	return "", false
+}
+
+func isWildcard(pattern string) bool {
+	return strings.HasPrefix(pattern, "*.")
+}
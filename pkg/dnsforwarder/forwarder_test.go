@@ -0,0 +1,175 @@
+package dnsforwarder
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
+)
+
+// fakeLearner records learned addresses
+type fakeLearner struct {
+	tunnel string
+	ips    []net.IP
+	ttl    time.Duration
+}
+
+func (l *fakeLearner) Learn(tunnel string, ips []net.IP, ttl time.Duration) error {
+	l.tunnel, l.ips, l.ttl = tunnel, ips, ttl
+	return nil
+}
+
+// fakeExchanger answers every query with A records of 192.0.2.x with ttl
+type fakeExchanger struct {
+	records int
+	ttl     uint32
+}
+
+func (e *fakeExchanger) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	for i := 0; i < e.records; i++ {
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN A 192.0.2.%d", req.Question[0].Name, e.ttl, i+1))
+		if err != nil {
+			return nil, err
+		}
+		resp.Answer = append(resp.Answer, rr)
+	}
+	return resp, nil
+}
+
+// fakeResponseWriter keeps a written message
+type fakeResponseWriter struct {
+	dns.ResponseWriter
+	local net.Addr
+	msg   *dns.Msg
+}
+
+func (w *fakeResponseWriter) LocalAddr() net.Addr { return w.local }
+func (w *fakeResponseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10053}
+}
+
+func (w *fakeResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func TestExcludeListener(t *testing.T) {
+	servers := []string{"127.0.0.53", "192.168.1.10", "8.8.8.8", "::1"}
+	localIPs := []net.IP{net.ParseIP("192.168.1.10")}
+
+	cases := []struct {
+		listen string
+		want   []string
+	}{
+		{"127.0.0.53:53", []string{"192.168.1.10:53", "8.8.8.8:53", "[::1]:53"}},
+		{"0.0.0.0:53", []string{"8.8.8.8:53"}},
+		{"[::]:53", []string{"8.8.8.8:53"}},
+		{":53", []string{"8.8.8.8:53"}},
+		// the forwarder on another port is not an upstream
+		{"0.0.0.0:5353", []string{"127.0.0.53:53", "192.168.1.10:53", "8.8.8.8:53", "[::1]:53"}},
+	}
+
+	for _, c := range cases {
+		if got := excludeListener(servers, "53", c.listen, localIPs); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("excludeListener(%s) = %v, want %v", c.listen, got, c.want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	f := New(zerolog.Nop(), nil, []Pattern{
+		{Pattern: "*.example.com", Tunnel: "wildcard"},
+		{Pattern: "*.internal.example.com", Tunnel: "internal"},
+		{Pattern: "db.internal.example.com", Tunnel: "db"},
+	}, nil, nil, 0)
+
+	cases := []struct {
+		name   string
+		tunnel string // empty if no pattern matches
+	}{
+		{"db.internal.example.com.", "db"},
+		{"app.internal.example.com.", "internal"},
+		{"www.example.com.", "wildcard"},
+		{"example.com.", ""},
+		{"example.org.", ""},
+	}
+
+	for _, c := range cases {
+		tunnel, ok := f.match(c.name)
+		if ok != (c.tunnel != "") || tunnel != c.tunnel {
+			t.Errorf("match(%s) = %q (matched: %v), want %q", c.name, tunnel, ok, c.tunnel)
+		}
+	}
+}
+
+func TestServeDNSMinTTL(t *testing.T) {
+	cases := []struct {
+		ttl  uint32
+		want time.Duration
+	}{
+		{ttl: 5, want: time.Minute},
+		{ttl: 300, want: 5 * time.Minute},
+	}
+
+	for _, c := range cases {
+		learner := &fakeLearner{}
+		remotes := map[string]Exchanger{"vpc": &fakeExchanger{records: 1, ttl: c.ttl}}
+		f := New(zerolog.Nop(), learner, []Pattern{{Pattern: "*.example.com", Tunnel: "vpc"}}, nil, remotes, time.Minute)
+
+		req := new(dns.Msg)
+		req.SetQuestion("app.example.com.", dns.TypeA)
+		w := &fakeResponseWriter{local: &net.TCPAddr{}}
+		f.ServeDNS(w, req)
+
+		if learner.tunnel != "vpc" || len(learner.ips) != 1 {
+			t.Fatalf("learned %v for %q", learner.ips, learner.tunnel)
+		}
+		if learner.ttl != c.want {
+			t.Errorf("learned with TTL %s for a record with TTL %d, want %s", learner.ttl, c.ttl, c.want)
+		}
+	}
+}
+
+func TestServeDNSTruncatesRemoteAnswers(t *testing.T) {
+	remotes := map[string]Exchanger{"vpc": &fakeExchanger{records: 100, ttl: 60}}
+	f := New(zerolog.Nop(), &fakeLearner{}, []Pattern{{Pattern: "*.example.com", Tunnel: "vpc"}}, nil, remotes, 0)
+
+	cases := []struct {
+		local     net.Addr
+		udpSize   uint16 // without EDNS0 if 0
+		truncated bool
+	}{
+		{local: &net.UDPAddr{}, truncated: true},
+		{local: &net.UDPAddr{}, udpSize: 4096},
+		{local: &net.TCPAddr{}},
+	}
+
+	for _, c := range cases {
+		req := new(dns.Msg)
+		req.SetQuestion("app.example.com.", dns.TypeA)
+		size := dns.MinMsgSize
+		if c.udpSize > 0 {
+			req.SetEdns0(c.udpSize, false)
+			size = int(c.udpSize)
+		}
+		w := &fakeResponseWriter{local: c.local}
+		f.ServeDNS(w, req)
+
+		if w.msg.Truncated != c.truncated {
+			t.Errorf("%s with UDP size %d: got truncated %v, want %v", c.local.Network(), c.udpSize, w.msg.Truncated, c.truncated)
+		}
+		if _, ok := c.local.(*net.UDPAddr); ok && w.msg.Len() > size {
+			t.Errorf("response of %d bytes does not fit in %d bytes", w.msg.Len(), size)
+		}
+		if !c.truncated && len(w.msg.Answer) != 100 {
+			t.Errorf("%s with UDP size %d: got %d answers", c.local.Network(), c.udpSize, len(w.msg.Answer))
+		}
+	}
+}
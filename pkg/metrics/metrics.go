@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+)
+
+const namespace = "mallet"
+
+const (
+	DirectionLocalToRemote = "local_to_remote"
+	DirectionRemoteToLocal = "remote_to_local"
+)
+
+var (
+	AcceptedConnections = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "accepted_connections_total",
+		Help:      "Number of accepted connections",
+	})
+	ActiveConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "active_connections",
+		Help:      "Number of connections being proxied",
+	}, []string{"tunnel"})
+	ActiveUDPSessions = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "active_udp_sessions",
+		Help:      "Number of UDP flows being proxied",
+	}, []string{"tunnel"})
+	ConnectionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "connection_duration_seconds",
+		Help:      "Duration of proxied connections",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"tunnel"})
+	TransferredBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "transferred_bytes_total",
+		Help:      "Number of bytes copied between local and remote",
+	}, []string{"tunnel", "direction"})
+	TunnelDialFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "tunnel_dial_failures_total",
+		Help:      "Number of failures to start a proxy via the tunnel",
+	}, []string{"tunnel"})
+	TimedOutConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "timed_out_connections_total",
+		Help:      "Number of connections closed by idle timeout or max lifetime",
+	}, []string{"tunnel", "reason"})
+	NATLookupFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "nat_lookup_failures_total",
+		Help:      "Number of failures to get original destinations of connections",
+	}, []string{"reason"})
+
+	ResolverUpdateDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "resolver",
+		Name:      "update_duration_seconds",
+		Help:      "Duration of updating redirected subnets",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	})
+	ResolverUpdateErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "resolver",
+		Name:      "update_errors_total",
+		Help:      "Number of failures to resolve targets or to update redirected subnets",
+	})
+	RedirectedSubnets = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "resolver",
+		Name:      "redirected_subnets",
+		Help:      "Number of subnets currently redirected",
+	})
+	NATRuleDrifts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "nat",
+		Name:      "rule_drifts_total",
+		Help:      "Number of times installed NAT rules were found missing or changed",
+	})
+	NATRuleRepairErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "nat",
+		Name:      "rule_repair_errors_total",
+		Help:      "Number of failures to verify or repair NAT rules",
+	})
+)
+
+// Serve serves /metrics on addr until it fails
+func Serve(logger zerolog.Logger, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	logger.Info().Msgf("Serving metrics on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
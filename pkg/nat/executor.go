@@ -0,0 +1,91 @@
+package nat
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/ryotarai/mallet/pkg/utils"
+)
+
+// Executor applies changes to rules and reads the current state of them
+type Executor interface {
+	// Run runs cmd which changes rules
+	Run(cmd *exec.Cmd) error
+	// Output runs cmd which only reads the current state and returns its stdout
+	Output(cmd *exec.Cmd) (string, error)
+	// WriteFile replaces the content of the file
+	WriteFile(name string, content string) error
+}
+
+// CommandExecutor runs commands and writes files
+type CommandExecutor struct{}
+
+func (e CommandExecutor) Run(cmd *exec.Cmd) error {
+	if err := utils.RunCommand(cmd); err != nil {
+		return fmt.Errorf("failed to run %s: %w", cmd.String(), err)
+	}
+	return nil
+}
+
+func (e CommandExecutor) Output(cmd *exec.Cmd) (string, error) {
+	stdout := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	if err := utils.RunCommand(cmd); err != nil {
+		return "", fmt.Errorf("failed to run %s: %w", cmd.String(), err)
+	}
+	return stdout.String(), nil
+}
+
+// WriteFile writes content to a temporary file and renames it so that the file is replaced atomically
+func (e CommandExecutor) WriteFile(name string, content string) error {
+	tmp := fmt.Sprintf("%s.tmp", name)
+	if err := ioutil.WriteFile(tmp, []byte(content), 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// DryRunExecutor prints commands and files as a shell script instead of applying them
+type DryRunExecutor struct {
+	w io.Writer
+}
+
+func NewDryRunExecutor(w io.Writer) *DryRunExecutor {
+	return &DryRunExecutor{w: w}
+}
+
+func (e *DryRunExecutor) Run(cmd *exec.Cmd) error {
+	command := strings.Join(cmd.Args, " ")
+	if cmd.Stdin == nil {
+		_, err := fmt.Fprintln(e.w, command)
+		return err
+	}
+
+	stdin, err := ioutil.ReadAll(cmd.Stdin)
+	if err != nil {
+		return err
+	}
+	return e.heredoc(command, string(stdin))
+}
+
+// Output runs nothing and returns empty output, as if no rules have been installed
+func (e *DryRunExecutor) Output(cmd *exec.Cmd) (string, error) {
+	return "", nil
+}
+
+func (e *DryRunExecutor) WriteFile(name string, content string) error {
+	return e.heredoc(fmt.Sprintf("cat > %s", name), content)
+}
+
+func (e *DryRunExecutor) heredoc(command string, content string) error {
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	_, err := fmt.Fprintf(e.w, "%s <<'EOF'\n%sEOF\n", command, content)
+	return err
+}
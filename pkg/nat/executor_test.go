@@ -0,0 +1,65 @@
+package nat
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestDryRunExecutor(t *testing.T) {
+	// commands fail if any of them is run
+	t.Setenv("PATH", t.TempDir())
+	pid := os.Getpid()
+
+	cases := []struct {
+		backend string
+		want    []string
+	}{
+		{
+			backend: BackendIptables,
+			want: []string{
+				"iptables-restore --noflush <<'EOF'\n*nat\n",
+				fmt.Sprintf("-I OUTPUT 1 -j mallet-pid%d\n", pid),
+				"ip -4 rule add fwmark 28012 lookup 27756\n",
+				"ip -4 route replace local default dev lo table 27756\n",
+				fmt.Sprintf("-I mallet-pid%d -j RETURN --dest 10.1.0.0/16 -p tcp\n", pid),
+				fmt.Sprintf("-A mallet-pid%d -j REDIRECT --dest 10.0.0.0/8 -p tcp --to-ports 1080\n", pid),
+			},
+		},
+		{
+			backend: BackendNFTables,
+			want: []string{
+				fmt.Sprintf("nft -f - <<'EOF'\ntable ip mallet-pid%d {\n", pid),
+				"ip -4 rule add fwmark 28012 lookup 27756\n",
+				fmt.Sprintf("flush set ip mallet-pid%d redirect\n", pid),
+				"10.0.0.0/8",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.backend, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			nat, err := New(zerolog.Nop(), 1080, 1081, false, c.backend, NewDryRunExecutor(buf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := nat.Setup(); err != nil {
+				t.Fatal(err)
+			}
+			if err := nat.RedirectSubnets([]string{"10.0.0.0/8"}, []string{"10.1.0.0/16"}); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, want := range c.want {
+				if !strings.Contains(buf.String(), want) {
+					t.Errorf("%q is not in:\n%s", want, buf.String())
+				}
+			}
+		})
+	}
+}
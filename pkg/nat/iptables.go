@@ -2,65 +2,126 @@ package nat
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"os/exec"
 	"regexp"
 	"strconv"
-	"syscall"
+	"strings"
 
-	"github.com/mitchellh/go-ps"
 	"github.com/rs/zerolog"
 )
 
-const (
-	SO_ORIGINAL_DST = 80
-)
-
 type Iptables struct {
 	logger    zerolog.Logger
 	proxyPort int
+	tproxy    bool
+	protocols []tproxyProtocol
 	subnets   []string
 	excludes  []string
+	commands  []string
+	executor  Executor
 }
 
-func NewIptables(logger zerolog.Logger, proxyPort int) *Iptables {
+// iptablesRule is a rule in a chain of a table
+type iptablesRule struct {
+	table string
+	chain string
+	args  []string
+}
+
+// NewIptables returns Iptables which redirects TCP connections to proxyPort with REDIRECT, or TPROXY if tproxy is true.
+// UDP datagrams are redirected to udpPort with TPROXY unless it is 0.
+// Rules are applied by executor.
+func NewIptables(logger zerolog.Logger, proxyPort int, udpPort int, tproxy bool, executor Executor) *Iptables {
+	commands := []string{"iptables"}
+	if _, err := exec.LookPath("ip6tables"); err == nil {
+		commands = append(commands, "ip6tables")
+	} else {
+		logger.Warn().Msg("ip6tables is not found, so IPv6 subnets are not redirected")
+	}
+
 	return &Iptables{
 		logger:    logger,
 		proxyPort: proxyPort,
+		tproxy:    tproxy,
+		protocols: tproxyProtocols(tproxy, proxyPort, udpPort),
+		commands:  commands,
+		executor:  executor,
 	}
 }
 
+// Setup creates chains and jump rules with iptables-restore, so that each table is updated atomically.
+// If it fails, chains created so far are deleted.
 func (p *Iptables) Setup() error {
 	chain := p.chainName()
 
-	if _, err := p.iptables([]string{"-t", "nat", "-N", chain}); err != nil {
-		return fmt.Errorf("failed to create a chain: %w", err)
+	for i, command := range p.commands {
+		if err := p.restore(command, p.setupScript(chain)); err != nil {
+			// tables are committed one by one, so some of them may have been created
+			for _, command := range p.commands[:i+1] {
+				for _, table := range p.tables() {
+					if err := p.deleteChain(command, table, chain); err != nil {
+						p.logger.Debug().Err(err).Msg("Failed to roll back")
+					}
+				}
+			}
+			return fmt.Errorf("failed to set up chains: %w", err)
+		}
 	}
 
-	if _, err := p.iptables([]string{"-t", "nat", "-F", chain}); err != nil {
-		return fmt.Errorf("failed to flush a chain: %w", err)
+	if len(p.protocols) > 0 {
+		if err := setupPolicyRouting(p.logger, p.executor); err != nil {
+			return err
+		}
 	}
 
-	if _, err := p.iptables([]string{"-t", "nat", "-I", "OUTPUT", "1", "-j", chain}); err != nil {
-		return fmt.Errorf("failed to insert a jump rule to OUTPUT chain: %w", err)
-	}
+	return nil
+}
 
-	if _, err := p.iptables([]string{"-t", "nat", "-I", "PREROUTING", "1", "-j", chain}); err != nil {
-		return fmt.Errorf("failed to insert a jump rule to OUTPUT chain: %w", err)
+// setupScript returns input of iptables-restore to create chains.
+// Connections are redirected with REDIRECT in nat table, and packets are redirected with TPROXY in mangle table.
+// Packets sent by local processes are marked in OUTPUT of mangle table so that they are routed to the loopback
+// interface and reach PREROUTING.
+func (p *Iptables) setupScript(chain string) string {
+	buf := &bytes.Buffer{}
+	for _, table := range p.tables() {
+		hooks := chainHooks(table, chain)
+
+		fmt.Fprintf(buf, "*%s\n", table)
+		// a declared chain is created, or flushed if it exists
+		for _, c := range uniqueChains(hooks) {
+			fmt.Fprintf(buf, ":%s - [0:0]\n", c)
+		}
+		for _, h := range hooks {
+			fmt.Fprintf(buf, "-I %s 1 -j %s\n", h[1], h[0])
+		}
+		for _, c := range uniqueChains(hooks) {
+			fmt.Fprintf(buf, "-A %s -j RETURN -m addrtype --dst-type LOCAL\n", c)
+			fmt.Fprintf(buf, "-A %s -j RETURN -m mark --mark %d\n", c, BypassMark)
+		}
+		fmt.Fprintf(buf, "COMMIT\n")
 	}
+	return buf.String()
+}
 
-	if _, err := p.iptables([]string{"-t", "nat", "-A", chain, "-j", "RETURN", "-m", "addrtype", "--dst-type", "LOCAL"}); err != nil {
-		return fmt.Errorf("failed to add a rule to return dst==local: %w", err)
+// tables returns tables in which chains are created
+func (p *Iptables) tables() []string {
+	var tables []string
+	if !p.tproxy {
+		tables = append(tables, "nat")
 	}
-
-	return nil
+	if len(p.protocols) > 0 {
+		tables = append(tables, "mangle")
+	}
+	return tables
 }
 
+// RedirectSubnets updates rules for the difference from the current subnets with iptables-restore.
+// If it fails for ip6tables after iptables, rules added by iptables are reverted.
 func (p *Iptables) RedirectSubnets(subnets []string, excludes []string) error {
-	chain := p.chainName()
-
 	currentExcludes := map[string]struct{}{}
 	for _, subnet := range p.excludes {
 		currentExcludes[subnet] = struct{}{}
@@ -76,11 +137,17 @@ func (p *Iptables) RedirectSubnets(subnets []string, excludes []string) error {
 		newSubnets[subnet] = struct{}{}
 	}
 
+	ops := map[string][]iptablesOp{} // command -> operations
+
 	// excluded subnets
 	for _, subnet := range excludes {
 		if _, found := currentExcludes[subnet]; !found {
-			if _, err := p.iptables([]string{"-t", "nat", "-I", chain, "-j", "RETURN", "--dest", subnet, "-p", "tcp"}); err != nil {
-				return fmt.Errorf("failed to add a RETURN rule for %s: %w", subnet, err)
+			command, ok := p.commandFor(subnet)
+			if !ok {
+				continue
+			}
+			for _, r := range p.excludeRules(subnet) {
+				ops[command] = append(ops[command], iptablesOp{op: "-I", rule: r})
 			}
 		}
 	}
@@ -88,8 +155,12 @@ func (p *Iptables) RedirectSubnets(subnets []string, excludes []string) error {
 	// add
 	for subnet := range newSubnets {
 		if _, found := currentSubnets[subnet]; !found {
-			if _, err := p.iptables([]string{"-t", "nat", "-A", chain, "-j", "REDIRECT", "--dest", subnet, "-p", "tcp", "--to-ports", strconv.Itoa(p.proxyPort)}); err != nil {
-				return fmt.Errorf("failed to redirect rule for %s: %w", subnet, err)
+			command, ok := p.commandFor(subnet)
+			if !ok {
+				continue
+			}
+			for _, r := range p.redirectRules(subnet) {
+				ops[command] = append(ops[command], iptablesOp{op: "-A", rule: r})
 			}
 		}
 	}
@@ -97,105 +168,368 @@ func (p *Iptables) RedirectSubnets(subnets []string, excludes []string) error {
 	// delete
 	for subnet := range currentSubnets {
 		if _, found := newSubnets[subnet]; !found {
-			if _, err := p.iptables([]string{"-t", "nat", "-D", chain, "-j", "REDIRECT", "--dest", subnet, "-p", "tcp", "--to-ports", strconv.Itoa(p.proxyPort)}); err != nil {
-				return fmt.Errorf("failed to delete redirect rule for %s: %w", subnet, err)
+			command, ok := p.commandFor(subnet)
+			if !ok {
+				continue
+			}
+			for _, r := range p.redirectRules(subnet) {
+				ops[command] = append(ops[command], iptablesOp{op: "-D", rule: r})
 			}
 		}
 	}
 
+	var applied []string
+	for _, command := range p.commands {
+		if len(ops[command]) == 0 {
+			continue
+		}
+		if err := p.restore(command, iptablesScript(ops[command])); err != nil {
+			for _, command := range applied {
+				if err := p.restore(command, iptablesScript(revertOps(ops[command]))); err != nil {
+					p.logger.Warn().Err(err).Str("command", command).Msg("Failed to roll back rules")
+				}
+			}
+			return fmt.Errorf("failed to update rules: %w", err)
+		}
+		applied = append(applied, command)
+	}
+
 	p.excludes = excludes
 	p.subnets = subnets
 
 	return nil
 }
 
-func (p *Iptables) Shutdown() error {
+// iptablesOp is an operation (-A, -I or -D) on a rule
+type iptablesOp struct {
+	op   string
+	rule iptablesRule
+}
+
+// revertOps returns operations which revert ops
+func revertOps(ops []iptablesOp) []iptablesOp {
+	reverted := make([]iptablesOp, 0, len(ops))
+	for i := len(ops) - 1; i >= 0; i-- {
+		op := "-D"
+		if ops[i].op == "-D" {
+			op = "-A"
+		}
+		reverted = append(reverted, iptablesOp{op: op, rule: ops[i].rule})
+	}
+	return reverted
+}
+
+// iptablesScript returns input of iptables-restore to apply ops.
+// Each table is committed in a transaction.
+func iptablesScript(ops []iptablesOp) string {
+	var tables []string
+	byTable := map[string][]iptablesOp{}
+	for _, op := range ops {
+		if _, ok := byTable[op.rule.table]; !ok {
+			tables = append(tables, op.rule.table)
+		}
+		byTable[op.rule.table] = append(byTable[op.rule.table], op)
+	}
+
+	buf := &bytes.Buffer{}
+	for _, table := range tables {
+		fmt.Fprintf(buf, "*%s\n", table)
+		for _, op := range byTable[table] {
+			fmt.Fprintf(buf, "%s %s %s\n", op.op, op.rule.chain, strings.Join(op.rule.args, " "))
+		}
+		fmt.Fprintf(buf, "COMMIT\n")
+	}
+	return buf.String()
+}
+
+// redirectRules returns rules to redirect packets to subnet
+func (p *Iptables) redirectRules(subnet string) []iptablesRule {
 	chain := p.chainName()
 
-	return p.deleteChain(chain)
+	var rules []iptablesRule
+	if !p.tproxy {
+		rules = append(rules, iptablesRule{table: "nat", chain: chain, args: []string{"-j", "REDIRECT", "--dest", subnet, "-p", "tcp", "--to-ports", strconv.Itoa(p.proxyPort)}})
+	}
+
+	onIP := "127.0.0.1"
+	if isIPv6Subnet(subnet) {
+		onIP = "::1"
+	}
+	mark := strconv.Itoa(tproxyMark)
+	for _, proto := range p.protocols {
+		rules = append(rules,
+			iptablesRule{table: "mangle", chain: chain, args: []string{"-j", "TPROXY", "--dest", subnet, "-p", proto.name, "--on-port", strconv.Itoa(proto.port), "--on-ip", onIP, "--tproxy-mark", mark}},
+			iptablesRule{table: "mangle", chain: chain + "-out", args: []string{"-j", "MARK", "--dest", subnet, "-p", proto.name, "--set-mark", mark}},
+		)
+	}
+
+	return rules
 }
 
-func (p *Iptables) deleteChain(chain string) error {
-	if _, err := p.iptables([]string{"-t", "nat", "-D", "OUTPUT", "-j", chain}); err != nil {
-		return fmt.Errorf("failed to delete a jump rule to OUTPUT chain: %w", err)
+// excludeRules returns rules to exclude subnet from redirection
+func (p *Iptables) excludeRules(subnet string) []iptablesRule {
+	chain := p.chainName()
+
+	var rules []iptablesRule
+	if !p.tproxy {
+		rules = append(rules, iptablesRule{table: "nat", chain: chain, args: []string{"-j", "RETURN", "--dest", subnet, "-p", "tcp"}})
 	}
 
-	if _, err := p.iptables([]string{"-t", "nat", "-D", "PREROUTING", "-j", chain}); err != nil {
-		return fmt.Errorf("failed to delete a jump rule to OUTPUT chain: %w", err)
+	for _, proto := range p.protocols {
+		rules = append(rules,
+			iptablesRule{table: "mangle", chain: chain, args: []string{"-j", "RETURN", "--dest", subnet, "-p", proto.name}},
+			iptablesRule{table: "mangle", chain: chain + "-out", args: []string{"-j", "RETURN", "--dest", subnet, "-p", proto.name}},
+		)
 	}
 
-	if _, err := p.iptables([]string{"-t", "nat", "-F", chain}); err != nil {
-		return fmt.Errorf("failed to flush a chain: %w", err)
+	return rules
+}
+
+// Verify checks chains, jumps to them and the number of rules in them with iptables -S
+func (p *Iptables) Verify() ([]string, error) {
+	var drifts []string
+	for _, command := range p.commands {
+		for _, table := range p.tables() {
+			hooks := chainHooks(table, p.chainName())
+			for _, h := range hooks {
+				ok, err := p.hasJump(command, table, h[1], h[0])
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					drifts = append(drifts, fmt.Sprintf("%s: jump from %s to %s in %s table is missing", command, h[1], h[0], table))
+				}
+			}
+
+			for _, c := range uniqueChains(hooks) {
+				stdout, err := p.iptables(command, []string{"-t", table, "-S", c})
+				if err != nil {
+					drifts = append(drifts, fmt.Sprintf("%s: chain %s in %s table is missing", command, c, table))
+					continue
+				}
+				actual := strings.Count(stdout, fmt.Sprintf("-A %s ", c))
+				if expected := len(p.chainRules(command, table, c)); actual != expected {
+					drifts = append(drifts, fmt.Sprintf("%s: chain %s in %s table has %d rules (expected %d)", command, c, table, actual, expected))
+				}
+			}
+		}
 	}
 
-	if _, err := p.iptables([]string{"-t", "nat", "-X", chain}); err != nil {
-		return fmt.Errorf("failed to delete a chain: %w", err)
+	if len(p.protocols) > 0 {
+		drifts = append(drifts, verifyPolicyRouting(p.executor)...)
+	}
+
+	return drifts, nil
+}
+
+// Repair flushes the chains and adds rules to them again, and adds jumps which are missing
+func (p *Iptables) Repair() error {
+	chain := p.chainName()
+
+	for _, command := range p.commands {
+		buf := &bytes.Buffer{}
+		for _, table := range p.tables() {
+			hooks := chainHooks(table, chain)
+
+			fmt.Fprintf(buf, "*%s\n", table)
+			for _, c := range uniqueChains(hooks) {
+				fmt.Fprintf(buf, ":%s - [0:0]\n", c)
+			}
+			for _, h := range hooks {
+				ok, err := p.hasJump(command, table, h[1], h[0])
+				if err != nil {
+					return err
+				}
+				if !ok {
+					fmt.Fprintf(buf, "-I %s 1 -j %s\n", h[1], h[0])
+				}
+			}
+			for _, c := range uniqueChains(hooks) {
+				for _, args := range p.chainRules(command, table, c) {
+					fmt.Fprintf(buf, "-A %s %s\n", c, strings.Join(args, " "))
+				}
+			}
+			fmt.Fprintf(buf, "COMMIT\n")
+		}
+
+		if err := p.restore(command, buf.String()); err != nil {
+			return fmt.Errorf("failed to repair chains: %w", err)
+		}
+	}
+
+	if len(p.protocols) > 0 {
+		if err := setupPolicyRouting(p.logger, p.executor); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (p *Iptables) GetNATDestination(conn *net.TCPConn) (string, *net.TCPConn, error) {
-	// https://gist.github.com/cannium/55ec625516a24da8f547aa2d93f49ecf
-	f, err := conn.File()
-	if err != nil {
-		return "", nil, err
+// chainRules returns arguments of rules which should be in chain of table in order
+func (p *Iptables) chainRules(command string, table string, chain string) [][]string {
+	rules := [][]string{
+		{"-j", "RETURN", "-m", "addrtype", "--dst-type", "LOCAL"},
+		{"-j", "RETURN", "-m", "mark", "--mark", strconv.Itoa(BypassMark)},
 	}
-	defer f.Close()
 
-	addr, err := syscall.GetsockoptIPv6Mreq(int(f.Fd()), syscall.IPPROTO_IP, SO_ORIGINAL_DST)
-	if err != nil {
-		return "", nil, err
+	// rules for IPv6 subnets are added by ip6tables
+	ipv6 := command == "ip6tables"
+	var all []iptablesRule
+	for _, subnet := range p.excludes {
+		if isIPv6Subnet(subnet) == ipv6 {
+			all = append(all, p.excludeRules(subnet)...)
+		}
+	}
+	for _, subnet := range p.subnets {
+		if isIPv6Subnet(subnet) == ipv6 {
+			all = append(all, p.redirectRules(subnet)...)
+		}
 	}
 
-	newConn, err := net.FileConn(f)
+	for _, r := range all {
+		if r.table == table && r.chain == chain {
+			rules = append(rules, r.args)
+		}
+	}
+	return rules
+}
+
+// hasJump returns true if hook has a rule jumping to chain
+func (p *Iptables) hasJump(command string, table string, hook string, chain string) (bool, error) {
+	stdout, err := p.iptables(command, []string{"-t", table, "-S", hook})
 	if err != nil {
-		return "", nil, err
+		return false, err
 	}
+	for _, line := range strings.Split(stdout, "\n") {
+		if line == fmt.Sprintf("-A %s -j %s", hook, chain) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
 
-	newTCPConn, ok := newConn.(*net.TCPConn)
-	if !ok {
-		panic("BUG: not TCPConn")
+// Shutdown deletes chains in all tables even if some of them fail to be deleted
+func (p *Iptables) Shutdown() error {
+	chain := p.chainName()
+
+	var errs []error
+	for _, command := range p.commands {
+		for _, table := range p.tables() {
+			if err := p.deleteChain(command, table, chain); err != nil {
+				errs = append(errs, err)
+			}
+		}
 	}
 
-	dest := fmt.Sprintf("%d.%d.%d.%d:%d",
-		addr.Multiaddr[4],
-		addr.Multiaddr[5],
-		addr.Multiaddr[6],
-		addr.Multiaddr[7],
-		uint16(addr.Multiaddr[2])<<8+uint16(addr.Multiaddr[3]))
+	return errors.Join(errs...)
+}
+
+// deleteChain deletes chains created by Setup in table atomically.
+// Jumps which no longer exist are skipped, since deleting them would fail the whole transaction.
+func (p *Iptables) deleteChain(command string, table string, chain string) error {
+	hooks := chainHooks(table, chain)
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "*%s\n", table)
+	for _, c := range uniqueChains(hooks) {
+		fmt.Fprintf(buf, ":%s - [0:0]\n", c)
+	}
+	for _, h := range hooks {
+		ok, err := p.hasJump(command, table, h[1], h[0])
+		if err != nil {
+			return fmt.Errorf("failed to delete a chain: %w", err)
+		}
+		if ok {
+			fmt.Fprintf(buf, "-D %s -j %s\n", h[1], h[0])
+		}
+	}
+	for _, c := range uniqueChains(hooks) {
+		fmt.Fprintf(buf, "-X %s\n", c)
+	}
+	fmt.Fprintf(buf, "COMMIT\n")
 
-	return dest, newTCPConn, nil
+	if err := p.restore(command, buf.String()); err != nil {
+		return fmt.Errorf("failed to delete a chain: %w", err)
+	}
+
+	return nil
 }
 
-func (p *Iptables) Cleanup() error {
-	re := regexp.MustCompile("mallet-pid(\\d+)")
+// chainHooks returns chains in table and built-in chains jumping to them ({chain, hook})
+func chainHooks(table string, chain string) [][]string {
+	if table == "mangle" {
+		return [][]string{{chain, "PREROUTING"}, {chain + "-out", "OUTPUT"}}
+	}
+	return [][]string{{chain, "OUTPUT"}, {chain, "PREROUTING"}}
+}
 
-	stdout, err := p.iptables([]string{"-t", "nat", "-n", "-L"})
-	if err != nil {
-		return err
+// uniqueChains returns chains in hooks ({chain, hook}) without duplicates
+func uniqueChains(hooks [][]string) []string {
+	var chains []string
+	seen := map[string]struct{}{}
+	for _, h := range hooks {
+		if _, ok := seen[h[0]]; !ok {
+			seen[h[0]] = struct{}{}
+			chains = append(chains, h[0])
+		}
 	}
+	return chains
+}
 
-	pids := map[int]struct{}{}
-	procs, err := ps.Processes()
-	for _, proc := range procs {
-		pids[proc.Pid()] = struct{}{}
+func (p *Iptables) GetNATDestination(conn *net.TCPConn) (string, *net.TCPConn, error) {
+	if p.tproxy {
+		// TPROXY does not rewrite the destination
+		return conn.LocalAddr().String(), conn, nil
 	}
+	return getOriginalDestination(conn)
+}
 
-	for _, match := range re.FindAllStringSubmatch(stdout, -1) {
-		pid, err := strconv.Atoi(match[1])
-		if err != nil {
-			return err
+func (p *Iptables) RuleSets() []RuleSet {
+	var ruleSets []RuleSet
+	for _, command := range p.commands {
+		for _, table := range p.tables() {
+			ruleSets = append(ruleSets, RuleSet{Command: command, Table: table, Chain: p.chainName()})
 		}
+	}
+	return ruleSets
+}
+
+func (p *Iptables) ListRuleSets() ([]RuleSet, error) {
+	// chains with "-out" suffix in mangle table are deleted together by deleteChain
+	re := regexp.MustCompile("Chain (mallet-pid\\d+) ")
+
+	var ruleSets []RuleSet
+	for _, command := range p.commands {
+		// chains in mangle table exist only with TPROXY
+		for _, table := range []string{"nat", "mangle"} {
+			stdout, err := p.iptables(command, []string{"-t", table, "-n", "-L"})
+			if err != nil {
+				return nil, err
+			}
 
-		if _, ok := pids[pid]; !ok {
-			p.logger.Info().Int("pid", pid).Msg("Deleting zombie iptables chain")
-			if err := p.deleteChain(fmt.Sprintf("mallet-pid%d", pid)); err != nil {
-				return err
+			for _, match := range re.FindAllStringSubmatch(stdout, -1) {
+				ruleSets = append(ruleSets, RuleSet{Command: command, Table: table, Chain: match[1]})
 			}
 		}
 	}
 
+	return ruleSets, nil
+}
+
+func (p *Iptables) DeleteRuleSets(ruleSets []RuleSet) error {
+	for _, r := range ruleSets {
+		if _, err := p.iptables(r.Command, []string{"-t", r.Table, "-n", "-L", r.Chain}); err != nil {
+			p.logger.Debug().Err(err).Str("ruleSet", r.String()).Msg("Skipping a chain which does not exist")
+			continue
+		}
+
+		p.logger.Info().Str("command", r.Command).Str("table", r.Table).Str("chain", r.Chain).Msg("Deleting iptables chain")
+		if err := p.deleteChain(r.Command, r.Table, r.Chain); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -203,12 +537,31 @@ func (p *Iptables) chainName() string {
 	return fmt.Sprintf("mallet-pid%d", os.Getpid())
 }
 
-func (p *Iptables) iptables(args []string) (string, error) {
-	stdout := &bytes.Buffer{}
-	cmd := exec.Command("iptables", args...)
-	cmd.Stdout = stdout
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("failed to run %s: %w", cmd.String(), err)
+// commandFor returns iptables or ip6tables depending on the address family of the subnet
+func (p *Iptables) commandFor(subnet string) (string, bool) {
+	if !isIPv6Subnet(subnet) {
+		return "iptables", true
 	}
-	return stdout.String(), nil
+
+	for _, command := range p.commands {
+		if command == "ip6tables" {
+			return command, true
+		}
+	}
+
+	p.logger.Warn().Str("subnet", subnet).Msg("Skipping IPv6 subnet because ip6tables is not available")
+	return "", false
+}
+
+// restore applies script with iptables-restore (or ip6tables-restore) without flushing other rules
+func (p *Iptables) restore(command string, script string) error {
+	p.logger.Debug().Str("command", command).Str("rules", script).Msg("Loading iptables rules")
+
+	cmd := exec.Command(command+"-restore", "--noflush")
+	cmd.Stdin = strings.NewReader(script)
+	return p.executor.Run(cmd)
+}
+
+func (p *Iptables) iptables(command string, args []string) (string, error) {
+	return p.executor.Output(exec.Command(command, args...))
 }
@@ -0,0 +1,71 @@
+package nat
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// fakeExecutor prints changes like DryRunExecutor and answers queries with output
+type fakeExecutor struct {
+	*DryRunExecutor
+	output func(args []string) (string, error)
+}
+
+func (e *fakeExecutor) Output(cmd *exec.Cmd) (string, error) {
+	return e.output(cmd.Args)
+}
+
+func TestIptablesShutdownSkipsMissingJumps(t *testing.T) {
+	chain := fmt.Sprintf("mallet-pid%d", os.Getpid())
+	buf := &bytes.Buffer{}
+	executor := &fakeExecutor{
+		DryRunExecutor: NewDryRunExecutor(buf),
+		output: func(args []string) (string, error) {
+			// the jump from PREROUTING has been deleted by someone else
+			if args[len(args)-1] == "OUTPUT" {
+				return fmt.Sprintf("-P OUTPUT ACCEPT\n-A OUTPUT -j %s\n", chain), nil
+			}
+			return "", nil
+		},
+	}
+	p := &Iptables{logger: zerolog.Nop(), commands: []string{"iptables"}, executor: executor}
+	if err := p.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	script := buf.String()
+	for _, want := range []string{":" + chain + " - [0:0]", "-D OUTPUT -j " + chain, "-X " + chain} {
+		if !strings.Contains(script, want+"\n") {
+			t.Errorf("%q is not in:\n%s", want, script)
+		}
+	}
+	if strings.Contains(script, "-D PREROUTING") {
+		t.Errorf("missing jump is deleted:\n%s", script)
+	}
+}
+
+func TestIptablesShutdownContinuesOnError(t *testing.T) {
+	buf := &bytes.Buffer{}
+	executor := &fakeExecutor{
+		DryRunExecutor: NewDryRunExecutor(buf),
+		output: func(args []string) (string, error) {
+			if args[0] == "ip6tables" {
+				return "", fmt.Errorf("failed to run %s", strings.Join(args, " "))
+			}
+			return "", nil
+		},
+	}
+	p := &Iptables{logger: zerolog.Nop(), commands: []string{"ip6tables", "iptables"}, executor: executor}
+	if err := p.Shutdown(); err == nil {
+		t.Error("error of ip6tables is not returned")
+	}
+	if !strings.Contains(buf.String(), "iptables-restore --noflush") {
+		t.Errorf("chains are not deleted with iptables:\n%s", buf.String())
+	}
+}
@@ -3,7 +3,12 @@ package nat
 import (
 	"fmt"
 	"net"
+	"os/exec"
+	"regexp"
 	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/rs/zerolog"
 )
@@ -13,18 +18,180 @@ type NAT interface {
 	GetNATDestination(conn *net.TCPConn) (string, *net.TCPConn, error)
 	Shutdown() error
 	RedirectSubnets(subnets []string, excludes []string) error
-	Cleanup() error
+	// RuleSets returns rule sets created by Setup
+	RuleSets() []RuleSet
+	// ListRuleSets returns rule sets created by any mallet process
+	ListRuleSets() ([]RuleSet, error)
+	// DeleteRuleSets deletes rule sets and rules in them. Rule sets which do not exist are ignored.
+	DeleteRuleSets(ruleSets []RuleSet) error
+	// Verify compares live rules with ones installed by Setup and RedirectSubnets, and returns differences
+	Verify() ([]string, error)
+	// Repair installs rules again
+	Repair() error
 }
 
+// RuleSet is an iptables chain, an nftables table or a pf anchor which holds rules of a mallet process.
+// Fields used depend on the backend.
+type RuleSet struct {
+	// Command is iptables or ip6tables
+	Command string `json:"command,omitempty"`
+	// Family is a family of nftables table
+	Family string `json:"family,omitempty"`
+	Table  string `json:"table,omitempty"`
+	Chain  string `json:"chain,omitempty"`
+	Anchor string `json:"anchor,omitempty"`
+}
+
+// ruleSetPIDPattern matches names of chains, tables and anchors, which contain the process ID
+var ruleSetPIDPattern = regexp.MustCompile(`^mallet(?:-|/)pid(\d+)$`)
+
+// PID returns the ID of the process which created the rule set, parsed from its name
+func (r RuleSet) PID() (int, bool) {
+	for _, name := range []string{r.Chain, r.Table, r.Anchor} {
+		if m := ruleSetPIDPattern.FindStringSubmatch(name); m != nil {
+			pid, err := strconv.Atoi(m[1])
+			return pid, err == nil
+		}
+	}
+	return 0, false
+}
+
+func (r RuleSet) String() string {
+	var parts []string
+	for _, s := range []string{r.Command, r.Family, r.Table, r.Chain, r.Anchor} {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+const (
+	BackendAuto     = "auto"
+	BackendIptables = "iptables"
+	BackendNFTables = "nftables"
+	BackendNetlink  = "netlink"
+	BackendPF       = "pf"
+)
+
 var StateNotFoundError = fmt.Errorf("nat state is not found")
 
-func New(logger zerolog.Logger, proxyPort int) (NAT, error) {
+// BypassMark is the mark of packets which are not redirected.
+// It is set on sockets of connections which the proxy makes directly, so that they are not redirected back to the proxy.
+const BypassMark = 0x6d62
+
+// SO_MARK is not defined in syscall for other than Linux
+const soMark = 36
+
+// SupportsBypass returns true if rules of backend skip packets marked with BypassMark
+func SupportsBypass(backend string) bool {
+	return backend != BackendPF
+}
+
+// BypassControl marks sockets with BypassMark. It is used as Control of net.Dialer and does nothing except on Linux.
+func BypassControl(network, address string, c syscall.RawConn) error {
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soMark, BypassMark)
+	}); err != nil {
+		return err
+	}
+	if serr != nil {
+		return fmt.Errorf("failed to set SO_MARK: %w", serr)
+	}
+	return nil
+}
+
+// New returns a NAT implementation for the backend.
+// If backend is empty or BackendAuto, the backend is chosen by ResolveBackend.
+// UDP datagrams are redirected to udpPort with TPROXY unless it is 0.
+// If tproxy is true, TCP connections are redirected with TPROXY too instead of REDIRECT (Linux only).
+// Rules are applied by executor, which may print them instead (see DryRunExecutor).
+func New(logger zerolog.Logger, proxyPort int, udpPort int, tproxy bool, backend string, executor Executor) (NAT, error) {
+	backend, err := ResolveBackend(backend)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug().Str("backend", backend).Msg("NAT backend")
+
+	switch backend {
+	case BackendPF:
+		if udpPort > 0 || tproxy {
+			return nil, fmt.Errorf("TPROXY is not supported with pf")
+		}
+		return NewPF(logger, proxyPort, executor), nil
+	case BackendIptables:
+		return NewIptables(logger, proxyPort, udpPort, tproxy, executor), nil
+	case BackendNFTables:
+		return NewNFTables(logger, proxyPort, udpPort, tproxy, executor), nil
+	case BackendNetlink:
+		if _, ok := executor.(*DryRunExecutor); ok {
+			// netlink messages are not readable, so the same ruleset is shown in the syntax of nft
+			logger.Info().Msg("netlink backend applies the following nft rules via netlink")
+			return NewNFTables(logger, proxyPort, udpPort, tproxy, executor), nil
+		}
+		return newNetlink(logger, proxyPort, udpPort, tproxy)
+	}
+
+	return nil, fmt.Errorf("unknown NAT backend: %s", backend)
+}
+
+// ResolveBackend returns backend, or the backend chosen by the OS and available commands if it is empty or BackendAuto
+func ResolveBackend(backend string) (string, error) {
+	if backend == "" || backend == BackendAuto {
+		return detectBackend()
+	}
+	return backend, nil
+}
+
+func detectBackend() (string, error) {
 	switch runtime.GOOS {
 	case "darwin":
-		return NewPF(logger, proxyPort), nil
+		return BackendPF, nil
 	case "linux":
-		return NewIptables(logger, proxyPort), nil
+		_, nftErr := exec.LookPath("nft")
+		_, iptablesErr := exec.LookPath("iptables")
+		switch {
+		case nftErr != nil && iptablesErr != nil:
+			// nftables is programmed via netlink without commands
+			return BackendNetlink, nil
+		case nftErr != nil:
+			return BackendIptables, nil
+		case iptablesErr != nil:
+			return BackendNFTables, nil
+		}
+		// iptables-nft is a compat shim on top of nftables and it reports "(nf_tables)" in its version
+		out, err := exec.Command("iptables", "--version").Output()
+		if err == nil && strings.Contains(string(out), "nf_tables") {
+			return BackendNFTables, nil
+		}
+		return BackendIptables, nil
 	}
 
-	return nil, fmt.Errorf("%s is not supported", runtime.GOOS)
+	return "", fmt.Errorf("%s is not supported", runtime.GOOS)
+}
+
+func isIPv6Subnet(subnet string) bool {
+	ip, _, err := net.ParseCIDR(subnet)
+	if err != nil {
+		ip = net.ParseIP(subnet)
+	}
+	return ip != nil && ip.To4() == nil
+}
+
+// splitSubnets splits subnets into IPv4 ones and IPv6 ones
+func splitSubnets(subnets []string) ([]string, []string) {
+	var v4, v6 []string
+	for _, subnet := range subnets {
+		if isIPv6Subnet(subnet) {
+			v6 = append(v6, subnet)
+		} else {
+			v4 = append(v4, subnet)
+		}
+	}
+	return v4, v6
 }
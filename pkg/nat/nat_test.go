@@ -0,0 +1,23 @@
+package nat
+
+import "testing"
+
+func TestRuleSetPID(t *testing.T) {
+	cases := []struct {
+		ruleSet RuleSet
+		pid     int // 0 if no PID is in the name
+	}{
+		{RuleSet{Command: "iptables", Table: "nat", Chain: "mallet-pid123"}, 123},
+		{RuleSet{Command: "nft", Family: "inet", Table: "mallet-pid45"}, 45},
+		{RuleSet{Command: "pfctl", Anchor: "mallet/pid6"}, 6},
+		{RuleSet{Command: "iptables", Table: "nat", Chain: "mallet-pid123-out"}, 0},
+		{RuleSet{Command: "pfctl", Anchor: "mallet"}, 0},
+	}
+
+	for _, c := range cases {
+		pid, ok := c.ruleSet.PID()
+		if ok != (c.pid != 0) || pid != c.pid {
+			t.Errorf("PID of %s = %d (found: %v), want %d", c.ruleSet, pid, ok, c.pid)
+		}
+	}
+}
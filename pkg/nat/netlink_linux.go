@@ -0,0 +1,580 @@
+package nat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/rs/zerolog"
+	"golang.org/x/sys/unix"
+)
+
+// netlinkFamilies are table families for IPv4 and IPv6 with their name in nft, address length and loopback address
+var netlinkFamilies = []struct {
+	family   nftables.TableFamily
+	name     string
+	keyType  nftables.SetDatatype
+	loopback net.IP
+}{
+	{family: nftables.TableFamilyIPv4, name: "ip", keyType: nftables.TypeIPAddr, loopback: net.IPv4(127, 0, 0, 1).To4()},
+	{family: nftables.TableFamilyIPv6, name: "ip6", keyType: nftables.TypeIP6Addr, loopback: net.IPv6loopback},
+}
+
+// Netlink programs the same ruleset as NFTables via netlink, so that the nft command is not required.
+// Errors are returned by the kernel for each batch of messages.
+type Netlink struct {
+	logger    zerolog.Logger
+	proxyPort int
+	tproxy    bool
+	protocols []tproxyProtocol
+	subnets   []string
+	excludes  []string
+
+	conn *nftables.Conn
+	sets map[nftables.TableFamily]*netlinkSets
+}
+
+type netlinkSets struct {
+	exclude  *nftables.Set
+	redirect *nftables.Set
+}
+
+// NewNetlink returns Netlink which redirects TCP connections to proxyPort with redirect, or tproxy if tproxy is true.
+// UDP datagrams are redirected to udpPort with tproxy unless it is 0.
+func NewNetlink(logger zerolog.Logger, proxyPort int, udpPort int, tproxy bool) *Netlink {
+	return &Netlink{
+		logger:    logger,
+		proxyPort: proxyPort,
+		tproxy:    tproxy,
+		protocols: tproxyProtocols(tproxy, proxyPort, udpPort),
+		sets:      map[nftables.TableFamily]*netlinkSets{},
+	}
+}
+
+func newNetlink(logger zerolog.Logger, proxyPort int, udpPort int, tproxy bool) (NAT, error) {
+	return NewNetlink(logger, proxyPort, udpPort, tproxy), nil
+}
+
+func (p *Netlink) Setup() error {
+	if _, err := p.connect(); err != nil {
+		return err
+	}
+
+	if err := p.addTables(); err != nil {
+		return err
+	}
+
+	if err := p.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to create tables: %w", err)
+	}
+
+	if len(p.protocols) > 0 {
+		if err := setupNetlinkPolicyRouting(p.logger); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addTables adds messages to create tables to the batch
+func (p *Netlink) addTables() error {
+	conn := p.conn
+	accept := nftables.ChainPolicyAccept
+	for _, f := range netlinkFamilies {
+		table := conn.AddTable(&nftables.Table{Family: f.family, Name: p.tableName()})
+
+		sets := &netlinkSets{
+			exclude:  &nftables.Set{Table: table, Name: "exclude", KeyType: f.keyType, Interval: true},
+			redirect: &nftables.Set{Table: table, Name: "redirect", KeyType: f.keyType, Interval: true},
+		}
+		for _, set := range []*nftables.Set{sets.exclude, sets.redirect} {
+			if err := conn.AddSet(set, nil); err != nil {
+				return fmt.Errorf("failed to add a set: %w", err)
+			}
+		}
+		p.sets[f.family] = sets
+
+		if !p.tproxy {
+			for _, hook := range []*nftables.ChainHook{nftables.ChainHookOutput, nftables.ChainHookPrerouting} {
+				name := "output"
+				if hook == nftables.ChainHookPrerouting {
+					name = "prerouting"
+				}
+				chain := conn.AddChain(&nftables.Chain{
+					Name:     name,
+					Table:    table,
+					Type:     nftables.ChainTypeNAT,
+					Hooknum:  hook,
+					Priority: nftables.ChainPriorityNATDest,
+					Policy:   &accept,
+				})
+
+				p.addRule(chain, localReturnExprs())
+				if hook == nftables.ChainHookOutput {
+					p.addRule(chain, bypassReturnExprs())
+				}
+				p.addRule(chain, matchExprs(f.family, sets.exclude, unix.IPPROTO_TCP), &expr.Verdict{Kind: expr.VerdictReturn})
+				p.addRule(chain, matchExprs(f.family, sets.redirect, unix.IPPROTO_TCP),
+					&expr.Immediate{Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(p.proxyPort))},
+					&expr.Redir{RegisterProtoMin: 1},
+				)
+			}
+		}
+
+		if len(p.protocols) > 0 {
+			// packets sent by local processes are marked to be routed to the loopback interface and reach prerouting
+			output := conn.AddChain(&nftables.Chain{
+				Name:     "tproxy_output",
+				Table:    table,
+				Type:     nftables.ChainTypeRoute,
+				Hooknum:  nftables.ChainHookOutput,
+				Priority: nftables.ChainPriorityMangle,
+				Policy:   &accept,
+			})
+			prerouting := conn.AddChain(&nftables.Chain{
+				Name:     "tproxy_prerouting",
+				Table:    table,
+				Type:     nftables.ChainTypeFilter,
+				Hooknum:  nftables.ChainHookPrerouting,
+				Priority: nftables.ChainPriorityMangle,
+				Policy:   &accept,
+			})
+
+			p.addRule(output, localReturnExprs())
+			p.addRule(output, bypassReturnExprs())
+			p.addRule(prerouting, localReturnExprs())
+			for _, proto := range p.protocols {
+				l4proto := byte(unix.IPPROTO_TCP)
+				if proto.name == "udp" {
+					l4proto = unix.IPPROTO_UDP
+				}
+
+				p.addRule(output, matchExprs(f.family, sets.exclude, l4proto), &expr.Verdict{Kind: expr.VerdictReturn})
+				p.addRule(output, matchExprs(f.family, sets.redirect, l4proto), markExprs()...)
+
+				p.addRule(prerouting, matchExprs(f.family, sets.exclude, l4proto), &expr.Verdict{Kind: expr.VerdictReturn})
+				tproxy := append(markExprs(),
+					&expr.Immediate{Register: 1, Data: f.loopback},
+					&expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(uint16(proto.port))},
+					&expr.TProxy{Family: byte(f.family), TableFamily: byte(f.family), RegAddr: 1, RegPort: 2},
+					&expr.Verdict{Kind: expr.VerdictAccept},
+				)
+				p.addRule(prerouting, matchExprs(f.family, sets.redirect, l4proto), tproxy...)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *Netlink) addRule(chain *nftables.Chain, match []expr.Any, exprs ...expr.Any) {
+	p.conn.AddRule(&nftables.Rule{
+		Table: chain.Table,
+		Chain: chain,
+		Exprs: append(match, exprs...),
+	})
+}
+
+// localReturnExprs returns expressions of "fib daddr type local return"
+func localReturnExprs() []expr.Any {
+	return []expr.Any{
+		&expr.Fib{Register: 1, FlagDADDR: true, ResultADDRTYPE: true},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL)},
+		&expr.Verdict{Kind: expr.VerdictReturn},
+	}
+}
+
+// bypassReturnExprs returns expressions of "meta mark BypassMark return"
+func bypassReturnExprs() []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(BypassMark)},
+		&expr.Verdict{Kind: expr.VerdictReturn},
+	}
+}
+
+// matchExprs returns expressions of "ip daddr @set meta l4proto proto"
+func matchExprs(family nftables.TableFamily, set *nftables.Set, l4proto byte) []expr.Any {
+	// offset and length of the destination address in the IPv4 or IPv6 header
+	offset, length := uint32(16), uint32(4)
+	if family == nftables.TableFamilyIPv6 {
+		offset, length = 24, 16
+	}
+
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: length},
+		&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{l4proto}},
+	}
+}
+
+// markExprs returns expressions of "meta mark set tproxyMark"
+func markExprs() []expr.Any {
+	return []expr.Any{
+		&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(tproxyMark)},
+		&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+	}
+}
+
+func (p *Netlink) RedirectSubnets(subnets []string, excludes []string) error {
+	if p.conn == nil {
+		return errors.New("tables are not set up")
+	}
+
+	// All sets are replaced in a single batch so that
+	// no packet sees a half-updated ruleset
+	if err := p.addElements(subnets, excludes); err != nil {
+		return err
+	}
+
+	if err := p.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to update redirected subnets: %w", err)
+	}
+
+	p.subnets = subnets
+	p.excludes = excludes
+
+	return nil
+}
+
+// addElements adds messages to replace elements of sets to the batch
+func (p *Netlink) addElements(subnets []string, excludes []string) error {
+	subnets4, subnets6 := splitSubnets(subnets)
+	excludes4, excludes6 := splitSubnets(excludes)
+
+	for _, f := range netlinkFamilies {
+		subnets, excludes := subnets4, excludes4
+		if f.family == nftables.TableFamilyIPv6 {
+			subnets, excludes = subnets6, excludes6
+		}
+
+		sets := p.sets[f.family]
+		for _, s := range []struct {
+			set     *nftables.Set
+			subnets []string
+		}{{sets.exclude, excludes}, {sets.redirect, subnets}} {
+			p.conn.FlushSet(s.set)
+			elements, err := intervalElements(s.subnets, int(f.keyType.Bytes))
+			if err != nil {
+				return err
+			}
+			if len(elements) == 0 {
+				continue
+			}
+			if err := p.conn.SetAddElements(s.set, elements); err != nil {
+				return fmt.Errorf("failed to add elements: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Verify checks tables, chains, the number of rules in them and whether sets have elements via netlink
+func (p *Netlink) Verify() ([]string, error) {
+	tables, err := p.listTables()
+	if err != nil {
+		return nil, err
+	}
+
+	subnets4, subnets6 := splitSubnets(p.subnets)
+
+	var drifts []string
+	for _, f := range netlinkFamilies {
+		table := findTable(tables, f.family, p.tableName())
+		if table == nil {
+			drifts = append(drifts, fmt.Sprintf("table %s %s is missing", f.name, p.tableName()))
+			continue
+		}
+
+		chains, err := p.conn.ListChainsOfTableFamily(f.family)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list chains: %w", err)
+		}
+		for name, count := range nftChainRuleCounts(p.tproxy, p.protocols) {
+			var chain *nftables.Chain
+			for _, c := range chains {
+				if c.Table.Name == table.Name && c.Name == name {
+					chain = c
+				}
+			}
+			if chain == nil {
+				drifts = append(drifts, fmt.Sprintf("chain %s in table %s %s is missing", name, f.name, table.Name))
+				continue
+			}
+			rules, err := p.conn.GetRules(table, chain)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list rules: %w", err)
+			}
+			if len(rules) != count {
+				drifts = append(drifts, fmt.Sprintf("chain %s in table %s %s has %d rules (expected %d)", name, f.name, table.Name, len(rules), count))
+			}
+		}
+
+		subnets := subnets4
+		if f.family == nftables.TableFamilyIPv6 {
+			subnets = subnets6
+		}
+		if len(subnets) > 0 {
+			set, err := p.conn.GetSetByName(table, "redirect")
+			if err != nil {
+				drifts = append(drifts, fmt.Sprintf("set redirect in table %s %s is missing", f.name, table.Name))
+				continue
+			}
+			elements, err := p.conn.GetSetElements(set)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list elements: %w", err)
+			}
+			if len(elements) == 0 {
+				drifts = append(drifts, fmt.Sprintf("set redirect in table %s %s is empty", f.name, table.Name))
+			}
+		}
+	}
+
+	if len(p.protocols) > 0 {
+		drifts = append(drifts, verifyNetlinkPolicyRouting()...)
+	}
+
+	return drifts, nil
+}
+
+// Repair creates tables again in a batch
+func (p *Netlink) Repair() error {
+	tables, err := p.listTables()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range netlinkFamilies {
+		if table := findTable(tables, f.family, p.tableName()); table != nil {
+			p.conn.DelTable(table)
+		}
+	}
+	if err := p.addTables(); err != nil {
+		return err
+	}
+	if err := p.addElements(p.subnets, p.excludes); err != nil {
+		return err
+	}
+
+	if err := p.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to repair tables: %w", err)
+	}
+
+	if len(p.protocols) > 0 {
+		if err := setupNetlinkPolicyRouting(p.logger); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func findTable(tables []*nftables.Table, family nftables.TableFamily, name string) *nftables.Table {
+	for _, table := range tables {
+		if table.Family == family && table.Name == name {
+			return table
+		}
+	}
+	return nil
+}
+
+// intervalElements returns elements of an interval set containing subnets.
+// Overlapping subnets are merged since the kernel rejects them (nft merges them with auto-merge).
+func intervalElements(subnets []string, size int) ([]nftables.SetElement, error) {
+	type interval struct {
+		start []byte
+		end   []byte // exclusive, or nil for the end of the address space
+	}
+
+	var intervals []interval
+	for _, subnet := range subnets {
+		_, ipnet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			ip := net.ParseIP(subnet)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid subnet: %s", subnet)
+			}
+			ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(size*8, size*8)}
+		}
+
+		start := ipnet.IP.To16()
+		if size == net.IPv4len {
+			start = ipnet.IP.To4()
+		}
+		if start == nil || len(ipnet.Mask) != size {
+			return nil, fmt.Errorf("invalid subnet: %s", subnet)
+		}
+
+		// end is the next address of the last address in the subnet
+		end := make([]byte, size)
+		for i := range end {
+			end[i] = start[i] | ^ipnet.Mask[i]
+		}
+		overflow := true
+		for i := size - 1; i >= 0 && overflow; i-- {
+			end[i]++
+			overflow = end[i] == 0
+		}
+		if overflow {
+			end = nil
+		}
+
+		intervals = append(intervals, interval{start: start.Mask(ipnet.Mask), end: end})
+	}
+
+	sort.Slice(intervals, func(i, j int) bool {
+		return bytes.Compare(intervals[i].start, intervals[j].start) < 0
+	})
+
+	var merged []interval
+	for _, in := range intervals {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			if last.end == nil || bytes.Compare(in.start, last.end) <= 0 {
+				if last.end != nil && (in.end == nil || bytes.Compare(in.end, last.end) > 0) {
+					last.end = in.end
+				}
+				continue
+			}
+		}
+		merged = append(merged, in)
+	}
+
+	var elements []nftables.SetElement
+	// like nft, the range before the first interval is closed explicitly
+	if len(merged) > 0 && !bytes.Equal(merged[0].start, make([]byte, size)) {
+		elements = append(elements, nftables.SetElement{Key: make([]byte, size), IntervalEnd: true})
+	}
+	for _, in := range merged {
+		elements = append(elements, nftables.SetElement{Key: in.start})
+		if in.end != nil {
+			elements = append(elements, nftables.SetElement{Key: in.end, IntervalEnd: true})
+		}
+	}
+
+	return elements, nil
+}
+
+// Shutdown deletes tables which exist, since a batch fails as a whole if any of them has been deleted
+func (p *Netlink) Shutdown() error {
+	if p.conn == nil {
+		// Setup has not been called
+		return nil
+	}
+	return p.DeleteRuleSets(p.RuleSets())
+}
+
+func (p *Netlink) GetNATDestination(conn *net.TCPConn) (string, *net.TCPConn, error) {
+	if p.tproxy {
+		// tproxy does not rewrite the destination
+		return conn.LocalAddr().String(), conn, nil
+	}
+	// nftables redirect is tracked by conntrack in the same way as iptables REDIRECT
+	return getOriginalDestination(conn)
+}
+
+func (p *Netlink) RuleSets() []RuleSet {
+	var ruleSets []RuleSet
+	for _, f := range netlinkFamilies {
+		ruleSets = append(ruleSets, RuleSet{Family: f.name, Table: p.tableName()})
+	}
+	return ruleSets
+}
+
+func (p *Netlink) ListRuleSets() ([]RuleSet, error) {
+	re := regexp.MustCompile("^mallet-pid\\d+$")
+
+	tables, err := p.listTables()
+	if err != nil {
+		return nil, err
+	}
+
+	var ruleSets []RuleSet
+	for _, table := range tables {
+		if !re.MatchString(table.Name) {
+			continue
+		}
+		for _, f := range netlinkFamilies {
+			if table.Family == f.family {
+				ruleSets = append(ruleSets, RuleSet{Family: f.name, Table: table.Name})
+			}
+		}
+	}
+
+	return ruleSets, nil
+}
+
+func (p *Netlink) DeleteRuleSets(ruleSets []RuleSet) error {
+	tables, err := p.listTables()
+	if err != nil {
+		return err
+	}
+
+	deleted := false
+	for _, r := range ruleSets {
+		found := false
+		for _, table := range tables {
+			for _, f := range netlinkFamilies {
+				if table.Family == f.family && f.name == r.Family && table.Name == r.Table {
+					p.logger.Info().Str("family", r.Family).Str("table", r.Table).Msg("Deleting nftables table")
+					p.conn.DelTable(table)
+					found = true
+					deleted = true
+				}
+			}
+		}
+		if !found {
+			p.logger.Debug().Str("ruleSet", r.String()).Msg("Skipping a table which does not exist")
+		}
+	}
+
+	if deleted {
+		if err := p.conn.Flush(); err != nil {
+			return fmt.Errorf("failed to delete tables: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (p *Netlink) listTables() ([]*nftables.Table, error) {
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	tables, err := conn.ListTables()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+	return tables, nil
+}
+
+// connect opens a netlink connection on first use
+func (p *Netlink) connect() (*nftables.Conn, error) {
+	if p.conn != nil {
+		return p.conn, nil
+	}
+
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink connection: %w", err)
+	}
+	p.conn = conn
+
+	return conn, nil
+}
+
+func (p *Netlink) tableName() string {
+	return fmt.Sprintf("mallet-pid%d", os.Getpid())
+}
@@ -0,0 +1,117 @@
+package nat
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/rs/zerolog"
+	"golang.org/x/sys/unix"
+)
+
+// formatElements returns elements as strings like "10.0.0.0" and "-10.1.0.0" for interval ends
+func formatElements(elements []nftables.SetElement) []string {
+	var s []string
+	for _, e := range elements {
+		prefix := ""
+		if e.IntervalEnd {
+			prefix = "-"
+		}
+		s = append(s, prefix+net.IP(e.Key).String())
+	}
+	return s
+}
+
+func TestIntervalElements(t *testing.T) {
+	cases := []struct {
+		name    string
+		subnets []string
+		size    int
+		want    []string
+	}{
+		{
+			name:    "single subnet",
+			subnets: []string{"10.0.0.0/8"},
+			size:    net.IPv4len,
+			want:    []string{"-0.0.0.0", "10.0.0.0", "-11.0.0.0"},
+		},
+		{
+			name:    "overlapping and adjacent subnets are merged",
+			subnets: []string{"10.1.0.0/16", "10.0.0.0/8", "11.0.0.0/8", "192.168.0.1"},
+			size:    net.IPv4len,
+			want:    []string{"-0.0.0.0", "10.0.0.0", "-12.0.0.0", "192.168.0.1", "-192.168.0.2"},
+		},
+		{
+			name:    "host bits are masked",
+			subnets: []string{"10.0.0.1/24"},
+			size:    net.IPv4len,
+			want:    []string{"-0.0.0.0", "10.0.0.0", "-10.0.1.0"},
+		},
+		{
+			name:    "end of the address space",
+			subnets: []string{"0.0.0.0/0"},
+			size:    net.IPv4len,
+			want:    []string{"0.0.0.0"},
+		},
+		{
+			name:    "IPv6",
+			subnets: []string{"2001:db8::/32", "::1"},
+			size:    net.IPv6len,
+			want:    []string{"-::", "::1", "-::2", "2001:db8::", "-2001:db9::"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			elements, err := intervalElements(c.subnets, c.size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := formatElements(elements)
+			if len(got) != len(c.want) {
+				t.Fatalf("got %v, want %v", got, c.want)
+			}
+			for i := range got {
+				if got[i] != c.want[i] {
+					t.Fatalf("got %v, want %v", got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestIntervalElementsInvalid(t *testing.T) {
+	for _, subnets := range [][]string{{"10.0.0.0/33"}, {"example.com"}, {"2001:db8::/32"}} {
+		if _, err := intervalElements(subnets, net.IPv4len); err == nil {
+			t.Errorf("%v is accepted", subnets)
+		}
+	}
+}
+
+func TestTproxyRoutingMessages(t *testing.T) {
+	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		if !isTproxyRule(tproxyRuleMessage(family)) {
+			t.Errorf("rule of family %d does not match", family)
+		}
+		if !isTproxyRoute(tproxyRouteMessage(family, 1)) {
+			t.Errorf("route of family %d does not match", family)
+		}
+	}
+
+	// a route in the main table is not the one to loopback
+	other := tproxyRouteMessage(unix.AF_INET, 1)
+	other.Data[rtnetlinkHeaderLen+4] = unix.RT_TABLE_MAIN
+	if isTproxyRoute(other) {
+		t.Error("route in another table matches")
+	}
+}
+
+func TestNetlinkBeforeSetup(t *testing.T) {
+	p := NewNetlink(zerolog.Nop(), 8080, 0, false)
+	if err := p.Shutdown(); err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+	if err := p.RedirectSubnets([]string{"10.0.0.0/8"}, nil); err == nil {
+		t.Error("RedirectSubnets succeeded without tables")
+	}
+}
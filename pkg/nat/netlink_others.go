@@ -0,0 +1,13 @@
+//go:build !linux
+
+package nat
+
+import (
+	"errors"
+
+	"github.com/rs/zerolog"
+)
+
+func newNetlink(logger zerolog.Logger, proxyPort int, udpPort int, tproxy bool) (NAT, error) {
+	return nil, errors.New("netlink backend is supported only on Linux")
+}
@@ -0,0 +1,342 @@
+package nat
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// nftFamilies are table families for IPv4 and IPv6.
+// "inet" family is not used because nat chains in it require Linux 5.2 or later.
+var nftFamilies = []nftFamily{
+	{name: "ip", addrType: "ipv4_addr", match: "ip", loopback: "127.0.0.1"},
+	{name: "ip6", addrType: "ipv6_addr", match: "ip6", loopback: "[::1]"},
+}
+
+type nftFamily struct {
+	name     string
+	addrType string
+	match    string
+	loopback string
+}
+
+type NFTables struct {
+	logger    zerolog.Logger
+	proxyPort int
+	tproxy    bool
+	protocols []tproxyProtocol
+	executor  Executor
+	subnets   []string
+	excludes  []string
+}
+
+// NewNFTables returns NFTables which redirects TCP connections to proxyPort with redirect, or tproxy if tproxy is true.
+// UDP datagrams are redirected to udpPort with tproxy unless it is 0.
+// Rules are applied by executor.
+func NewNFTables(logger zerolog.Logger, proxyPort int, udpPort int, tproxy bool, executor Executor) *NFTables {
+	return &NFTables{
+		logger:    logger,
+		proxyPort: proxyPort,
+		tproxy:    tproxy,
+		protocols: tproxyProtocols(tproxy, proxyPort, udpPort),
+		executor:  executor,
+	}
+}
+
+func (p *NFTables) Setup() error {
+	script := p.setupScript()
+	p.logger.Debug().Str("rules", script).Msg("Loading nftables rules")
+
+	if err := p.apply([]string{"-f", "-"}, script); err != nil {
+		return fmt.Errorf("failed to create tables: %w", err)
+	}
+
+	if len(p.protocols) > 0 {
+		if err := setupPolicyRouting(p.logger, p.executor); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setupScript returns input of nft to create tables
+func (p *NFTables) setupScript() string {
+	table := p.tableName()
+
+	buf := &bytes.Buffer{}
+	for _, family := range nftFamilies {
+		fmt.Fprintf(buf, "table %s %s {\n", family.name, table)
+		fmt.Fprintf(buf, "\tset exclude { type %s; flags interval; auto-merge; }\n", family.addrType)
+		fmt.Fprintf(buf, "\tset redirect { type %s; flags interval; auto-merge; }\n", family.addrType)
+		if !p.tproxy {
+			for _, hook := range []string{"output", "prerouting"} {
+				fmt.Fprintf(buf, "\tchain %s {\n", hook)
+				fmt.Fprintf(buf, "\t\ttype nat hook %s priority -100; policy accept;\n", hook)
+				fmt.Fprintf(buf, "\t\tfib daddr type local return\n")
+				if hook == "output" {
+					fmt.Fprintf(buf, "\t\tmeta mark %d return\n", BypassMark)
+				}
+				fmt.Fprintf(buf, "\t\t%s daddr @exclude meta l4proto tcp return\n", family.match)
+				fmt.Fprintf(buf, "\t\t%s daddr @redirect meta l4proto tcp redirect to :%d\n", family.match, p.proxyPort)
+				fmt.Fprintf(buf, "\t}\n")
+			}
+		}
+		if len(p.protocols) > 0 {
+			// packets sent by local processes are marked to be routed to the loopback interface and reach prerouting
+			fmt.Fprintf(buf, "\tchain tproxy_output {\n")
+			fmt.Fprintf(buf, "\t\ttype route hook output priority -150; policy accept;\n")
+			fmt.Fprintf(buf, "\t\tfib daddr type local return\n")
+			fmt.Fprintf(buf, "\t\tmeta mark %d return\n", BypassMark)
+			for _, proto := range p.protocols {
+				fmt.Fprintf(buf, "\t\t%s daddr @exclude meta l4proto %s return\n", family.match, proto.name)
+				fmt.Fprintf(buf, "\t\t%s daddr @redirect meta l4proto %s meta mark set %d\n", family.match, proto.name, tproxyMark)
+			}
+			fmt.Fprintf(buf, "\t}\n")
+			fmt.Fprintf(buf, "\tchain tproxy_prerouting {\n")
+			fmt.Fprintf(buf, "\t\ttype filter hook prerouting priority -150; policy accept;\n")
+			fmt.Fprintf(buf, "\t\tfib daddr type local return\n")
+			for _, proto := range p.protocols {
+				fmt.Fprintf(buf, "\t\t%s daddr @exclude meta l4proto %s return\n", family.match, proto.name)
+				fmt.Fprintf(buf, "\t\t%s daddr @redirect meta l4proto %s meta mark set %d tproxy to %s:%d accept\n", family.match, proto.name, tproxyMark, family.loopback, proto.port)
+			}
+			fmt.Fprintf(buf, "\t}\n")
+		}
+		fmt.Fprintf(buf, "}\n")
+	}
+	return buf.String()
+}
+
+func (p *NFTables) RedirectSubnets(subnets []string, excludes []string) error {
+	// All sets are replaced in a single transaction so that
+	// no packet sees a half-updated ruleset
+	script := p.elementsScript(subnets, excludes)
+	p.logger.Debug().Str("rules", script).Msg("Loading nftables set elements")
+
+	if err := p.apply([]string{"-f", "-"}, script); err != nil {
+		return fmt.Errorf("failed to update redirected subnets: %w", err)
+	}
+
+	p.subnets = subnets
+	p.excludes = excludes
+
+	return nil
+}
+
+// elementsScript returns input of nft to replace elements of sets
+func (p *NFTables) elementsScript(subnets []string, excludes []string) string {
+	table := p.tableName()
+
+	subnets4, subnets6 := splitSubnets(subnets)
+	excludes4, excludes6 := splitSubnets(excludes)
+
+	buf := &bytes.Buffer{}
+	for _, family := range nftFamilies {
+		subnets, excludes := subnets4, excludes4
+		if family.name == "ip6" {
+			subnets, excludes = subnets6, excludes6
+		}
+		fmt.Fprintf(buf, "flush set %s %s exclude\n", family.name, table)
+		fmt.Fprintf(buf, "flush set %s %s redirect\n", family.name, table)
+		if len(excludes) > 0 {
+			fmt.Fprintf(buf, "add element %s %s exclude { %s }\n", family.name, table, strings.Join(excludes, ", "))
+		}
+		if len(subnets) > 0 {
+			fmt.Fprintf(buf, "add element %s %s redirect { %s }\n", family.name, table, strings.Join(subnets, ", "))
+		}
+	}
+	return buf.String()
+}
+
+// Verify checks tables, chains, the number of rules in them and whether sets have elements with nft list
+func (p *NFTables) Verify() ([]string, error) {
+	table := p.tableName()
+	subnets4, subnets6 := splitSubnets(p.subnets)
+
+	var drifts []string
+	for _, family := range nftFamilies {
+		stdout, err := p.nft("list", "table", family.name, table)
+		if err != nil {
+			drifts = append(drifts, fmt.Sprintf("table %s %s is missing", family.name, table))
+			continue
+		}
+		blocks := nftBlocks(stdout)
+
+		for name, expected := range nftChainRuleCounts(p.tproxy, p.protocols) {
+			lines, ok := blocks["chain "+name]
+			if !ok {
+				drifts = append(drifts, fmt.Sprintf("chain %s in table %s %s is missing", name, family.name, table))
+				continue
+			}
+			// the first line is the type of the chain
+			if actual := len(lines) - 1; actual != expected {
+				drifts = append(drifts, fmt.Sprintf("chain %s in table %s %s has %d rules (expected %d)", name, family.name, table, actual, expected))
+			}
+		}
+
+		subnets := subnets4
+		if family.name == "ip6" {
+			subnets = subnets6
+		}
+		if len(subnets) > 0 && !strings.Contains(strings.Join(blocks["set redirect"], "\n"), "elements = ") {
+			drifts = append(drifts, fmt.Sprintf("set redirect in table %s %s is empty", family.name, table))
+		}
+	}
+
+	if len(p.protocols) > 0 {
+		drifts = append(drifts, verifyPolicyRouting(p.executor)...)
+	}
+
+	return drifts, nil
+}
+
+// Repair creates tables again in a transaction
+func (p *NFTables) Repair() error {
+	table := p.tableName()
+
+	buf := &bytes.Buffer{}
+	for _, family := range nftFamilies {
+		// a table is added before deleting it so that deleting does not fail if it is missing
+		fmt.Fprintf(buf, "table %s %s\n", family.name, table)
+		fmt.Fprintf(buf, "delete table %s %s\n", family.name, table)
+	}
+	buf.WriteString(p.setupScript())
+	buf.WriteString(p.elementsScript(p.subnets, p.excludes))
+
+	if err := p.apply([]string{"-f", "-"}, buf.String()); err != nil {
+		return fmt.Errorf("failed to repair tables: %w", err)
+	}
+
+	if len(p.protocols) > 0 {
+		if err := setupPolicyRouting(p.logger, p.executor); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// nftChainRuleCounts returns the number of rules in each chain created by Setup of NFTables and Netlink
+func nftChainRuleCounts(tproxy bool, protocols []tproxyProtocol) map[string]int {
+	counts := map[string]int{}
+	if !tproxy {
+		counts["output"] = 4
+		counts["prerouting"] = 3
+	}
+	if len(protocols) > 0 {
+		counts["tproxy_output"] = 2 + 2*len(protocols)
+		counts["tproxy_prerouting"] = 1 + 2*len(protocols)
+	}
+	return counts
+}
+
+// nftBlocks returns lines in each block (e.g. "chain output") of a table listed by nft
+func nftBlocks(s string) map[string][]string {
+	blocks := map[string][]string{}
+	var name string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "table "):
+		case strings.HasSuffix(line, " {") && name == "":
+			name = strings.TrimSuffix(line, " {")
+			blocks[name] = nil
+		case line == "}":
+			name = ""
+		case line != "" && name != "":
+			blocks[name] = append(blocks[name], line)
+		}
+	}
+	return blocks
+}
+
+func (p *NFTables) Shutdown() error {
+	table := p.tableName()
+
+	for _, family := range nftFamilies {
+		if err := p.deleteTable(family.name, table); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *NFTables) deleteTable(family string, table string) error {
+	if err := p.apply([]string{"delete", "table", family, table}, ""); err != nil {
+		return fmt.Errorf("failed to delete a table: %w", err)
+	}
+	return nil
+}
+
+func (p *NFTables) GetNATDestination(conn *net.TCPConn) (string, *net.TCPConn, error) {
+	if p.tproxy {
+		// tproxy does not rewrite the destination
+		return conn.LocalAddr().String(), conn, nil
+	}
+	// nftables redirect is tracked by conntrack in the same way as iptables REDIRECT
+	return getOriginalDestination(conn)
+}
+
+func (p *NFTables) RuleSets() []RuleSet {
+	var ruleSets []RuleSet
+	for _, family := range nftFamilies {
+		ruleSets = append(ruleSets, RuleSet{Family: family.name, Table: p.tableName()})
+	}
+	return ruleSets
+}
+
+func (p *NFTables) ListRuleSets() ([]RuleSet, error) {
+	re := regexp.MustCompile("(?m)^table (ip6?) (mallet-pid\\d+)$")
+
+	stdout, err := p.nft("list", "tables")
+	if err != nil {
+		return nil, err
+	}
+
+	var ruleSets []RuleSet
+	for _, match := range re.FindAllStringSubmatch(stdout, -1) {
+		ruleSets = append(ruleSets, RuleSet{Family: match[1], Table: match[2]})
+	}
+
+	return ruleSets, nil
+}
+
+func (p *NFTables) DeleteRuleSets(ruleSets []RuleSet) error {
+	for _, r := range ruleSets {
+		if _, err := p.nft("list", "table", r.Family, r.Table); err != nil {
+			p.logger.Debug().Err(err).Str("ruleSet", r.String()).Msg("Skipping a table which does not exist")
+			continue
+		}
+
+		p.logger.Info().Str("family", r.Family).Str("table", r.Table).Msg("Deleting nftables table")
+		if err := p.deleteTable(r.Family, r.Table); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *NFTables) tableName() string {
+	return fmt.Sprintf("mallet-pid%d", os.Getpid())
+}
+
+// apply runs nft to change rules
+func (p *NFTables) apply(args []string, stdin string) error {
+	cmd := exec.Command("nft", args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	return p.executor.Run(cmd)
+}
+
+func (p *NFTables) nft(args ...string) (string, error) {
+	return p.executor.Output(exec.Command("nft", args...))
+}
@@ -4,15 +4,12 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
-	"github.com/ryotarai/mallet/pkg/utils"
 	"net"
 	"os"
 	"os/exec"
 	"regexp"
-	"strconv"
 	"strings"
 
-	"github.com/mitchellh/go-ps"
 	"github.com/rs/zerolog"
 )
 
@@ -22,18 +19,22 @@ const pfConf = "/etc/pf.conf"
 type PF struct {
 	logger    zerolog.Logger
 	proxyPort int
+	executor  Executor
+	subnets   []string
+	excludes  []string
 }
 
-func NewPF(logger zerolog.Logger, proxyPort int) *PF {
+func NewPF(logger zerolog.Logger, proxyPort int, executor Executor) *PF {
 	return &PF{
 		logger:    logger,
 		proxyPort: proxyPort,
+		executor:  executor,
 	}
 }
 
 func (p *PF) Setup() error {
 	// enable
-	if _, err := p.pfctl([]string{"-E"}, ""); err != nil {
+	if err := p.apply([]string{"-E"}, ""); err != nil {
 		return fmt.Errorf("failed to enable pf: %w", err)
 	}
 
@@ -42,7 +43,7 @@ func (p *PF) Setup() error {
 		return err
 	}
 
-	if _, err := p.pfctl([]string{"-f", pfConf}, ""); err != nil {
+	if err := p.apply([]string{"-f", pfConf}, ""); err != nil {
 		return err
 	}
 
@@ -53,38 +54,95 @@ func (p *PF) RedirectSubnets(subnets []string, excludes []string) error {
 	buf := &bytes.Buffer{}
 
 	for _, subnet := range subnets {
-		fmt.Fprintf(buf, "rdr pass on lo0 inet proto tcp from ! 127.0.0.1 to %s -> 127.0.0.1 port %d\n", subnet, p.proxyPort)
+		family, loopback := pfFamily(subnet)
+		fmt.Fprintf(buf, "rdr pass on lo0 %s proto tcp from ! %s to %s -> %s port %d\n", family, loopback, subnet, loopback, p.proxyPort)
 	}
 	for _, subnet := range subnets {
-		fmt.Fprintf(buf, "pass out route-to lo0 inet proto tcp from any to %s flags S/SA keep state\n", subnet)
+		family, _ := pfFamily(subnet)
+		fmt.Fprintf(buf, "pass out route-to lo0 %s proto tcp from any to %s flags S/SA keep state\n", family, subnet)
 	}
 	for _, subnet := range excludes {
-		fmt.Fprintf(buf, "pass out inet proto tcp to %s\n", subnet)
+		family, _ := pfFamily(subnet)
+		fmt.Fprintf(buf, "pass out %s proto tcp to %s\n", family, subnet)
 	}
 
 	p.logger.Debug().Str("rules", buf.String()).Msg("Loading pf rules")
 
-	if _, err := p.pfctl([]string{"-a", p.anchorName(), "-f", "-"}, buf.String()); err != nil {
+	if err := p.apply([]string{"-a", p.anchorName(), "-f", "-"}, buf.String()); err != nil {
 		return err
 	}
 
+	p.subnets = subnets
+	p.excludes = excludes
+
 	return nil
 }
 
+// Verify checks that pf is enabled, the main ruleset has mallet anchors and the anchor has as many rules as loaded
+func (p *PF) Verify() ([]string, error) {
+	var drifts []string
+
+	info, err := p.pfctl("-s", "info")
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(info, "Status: Enabled") {
+		drifts = append(drifts, "pf is disabled")
+	}
+
+	for _, c := range []struct {
+		show   string
+		anchor string
+	}{{"nat", `rdr-anchor "mallet/*"`}, {"rules", `anchor "mallet/*"`}} {
+		stdout, err := p.pfctl("-s", c.show)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.Contains(stdout, c.anchor) {
+			drifts = append(drifts, fmt.Sprintf("%s is missing in the main ruleset", c.anchor))
+		}
+	}
+
+	for _, c := range []struct {
+		show     string
+		expected int
+	}{{"nat", len(p.subnets)}, {"rules", len(p.subnets) + len(p.excludes)}} {
+		stdout, err := p.pfctl("-a", p.anchorName(), "-s", c.show)
+		if err != nil {
+			return nil, err
+		}
+		if actual := countLines(stdout); actual != c.expected {
+			drifts = append(drifts, fmt.Sprintf("anchor %s has %d %s (expected %d)", p.anchorName(), actual, c.show, c.expected))
+		}
+	}
+
+	return drifts, nil
+}
+
+// Repair loads the anchor again.
+// pf is not enabled again since every pfctl -E takes a reference to pf which is never released.
+func (p *PF) Repair() error {
+	return p.RedirectSubnets(p.subnets, p.excludes)
+}
+
 func (p *PF) Shutdown() error {
-	_, err := p.pfctl([]string{"-F", "all", "-a", p.anchorName()}, "")
-	return err
+	return p.apply([]string{"-F", "all", "-a", p.anchorName()}, "")
 }
 
 func (p *PF) GetNATDestination(conn *net.TCPConn) (string, *net.TCPConn, error) {
-	stdout, err := p.pfctl([]string{"-s", "states"}, "")
+	stdout, err := p.pfctl("-s", "states")
 	if err != nil {
 		return "", nil, err
 	}
 
 	p.logger.Trace().Str("states", stdout).Msg("Output of pfctl -s states")
 
-	re, err := regexp.Compile(fmt.Sprintf("(?m)^ALL tcp %s -> ([^\\s]+).+$", regexp.QuoteMeta(conn.RemoteAddr().String())))
+	src, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return "", nil, StateNotFoundError
+	}
+
+	re, err := regexp.Compile(fmt.Sprintf("(?m)^ALL tcp %s -> ([^\\s]+).+$", regexp.QuoteMeta(pfFormatAddr(src))))
 	if err != nil {
 		return "", nil, err
 	}
@@ -92,51 +150,67 @@ func (p *PF) GetNATDestination(conn *net.TCPConn) (string, *net.TCPConn, error)
 	p.logger.Trace().Str("re", re.String()).Msg("Finding state")
 
 	if match := re.FindStringSubmatch(stdout); match != nil {
-		return match[1], conn, nil
+		return pfParseAddr(match[1]), conn, nil
 	}
 
 	return "", nil, StateNotFoundError
 }
 
-func (p *PF) Cleanup() error {
-	stdout, err := p.pfctl([]string{"-s", "Anchors", "-a", "mallet"}, "")
+func (p *PF) RuleSets() []RuleSet {
+	return []RuleSet{{Anchor: p.anchorName()}}
+}
+
+func (p *PF) ListRuleSets() ([]RuleSet, error) {
+	stdout, err := p.pfctl("-s", "Anchors", "-a", "mallet")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	pids := map[int]struct{}{}
-	procs, err := ps.Processes()
-	for _, proc := range procs {
-		pids[proc.Pid()] = struct{}{}
+	var ruleSets []RuleSet
+	re := regexp.MustCompile("mallet/pid\\d+")
+	for _, anchor := range re.FindAllString(stdout, -1) {
+		ruleSets = append(ruleSets, RuleSet{Anchor: anchor})
 	}
 
-	re := regexp.MustCompile("mallet/pid(\\d+)")
-	for _, match := range re.FindAllStringSubmatch(stdout, -1) {
-		pid, err := strconv.Atoi(match[1])
-		if err != nil {
-			return err
+	return ruleSets, nil
+}
+
+func (p *PF) DeleteRuleSets(ruleSets []RuleSet) error {
+	existing, err := p.ListRuleSets()
+	if err != nil {
+		return err
+	}
+	exists := map[string]bool{}
+	for _, r := range existing {
+		exists[r.Anchor] = true
+	}
+
+	for _, r := range ruleSets {
+		if !exists[r.Anchor] {
+			p.logger.Debug().Str("ruleSet", r.String()).Msg("Skipping an anchor which does not exist")
+			continue
 		}
 
-		if _, ok := pids[pid]; !ok {
-			p.logger.Info().Int("pid", pid).Msg("Deleting zombie pf anchor")
-			if _, err := p.pfctl([]string{"-F", "all", "-a", p.anchorNameForPid(pid)}, ""); err != nil {
-				return err
-			}
+		p.logger.Info().Str("anchor", r.Anchor).Msg("Deleting pf anchor")
+		if err := p.apply([]string{"-F", "all", "-a", r.Anchor}, ""); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func (p *PF) pfctl(args []string, stdin string) (string, error) {
-	stdout := &bytes.Buffer{}
+// apply runs pfctl to change rules
+func (p *PF) apply(args []string, stdin string) error {
 	cmd := exec.Command("pfctl", args...)
-	cmd.Stdout = stdout
-	cmd.Stdin = strings.NewReader(stdin)
-	if err := utils.RunCommand(cmd); err != nil {
-		return "", fmt.Errorf("failed to run %s: %w", cmd.String(), err)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
 	}
-	return stdout.String(), nil
+	return p.executor.Run(cmd)
+}
+
+func (p *PF) pfctl(args ...string) (string, error) {
+	return p.executor.Output(exec.Command("pfctl", args...))
 }
 
 func (p *PF) anchorName() string {
@@ -208,21 +282,43 @@ func (p *PF) writeMainRules() error {
 		return err
 	}
 
-	f, err := os.OpenFile(fmt.Sprintf("%s.tmp", pfConf), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
+	return p.executor.WriteFile(pfConf, content)
+}
 
-	if _, err := f.WriteString(content); err != nil {
-		return err
+// countLines returns the number of lines which are not empty
+func countLines(s string) int {
+	n := 0
+	for _, line := range strings.Split(s, "\n") {
+		if strings.TrimSpace(line) != "" {
+			n++
+		}
 	}
+	return n
+}
 
-	f.Close()
+// pfFamily returns the address family keyword and the loopback address for the subnet
+func pfFamily(subnet string) (string, string) {
+	if isIPv6Subnet(subnet) {
+		return "inet6", "::1"
+	}
+	return "inet", "127.0.0.1"
+}
 
-	if err := os.Rename(fmt.Sprintf("%s.tmp", pfConf), pfConf); err != nil {
-		return err
+// pfFormatAddr formats an address in the way pfctl shows it.
+// pfctl shows an IPv6 address with a port as "addr[port]".
+func pfFormatAddr(addr *net.TCPAddr) string {
+	if addr.IP.To4() == nil {
+		return fmt.Sprintf("%s[%d]", addr.IP.String(), addr.Port)
 	}
+	return fmt.Sprintf("%s:%d", addr.IP.String(), addr.Port)
+}
 
-	return nil
+// pfParseAddr converts an address shown by pfctl to host:port form
+func pfParseAddr(addr string) string {
+	if strings.HasSuffix(addr, "]") {
+		if i := strings.LastIndex(addr, "["); i >= 0 {
+			return net.JoinHostPort(addr[:i], addr[i+1:len(addr)-1])
+		}
+	}
+	return addr
 }
@@ -0,0 +1,168 @@
+package nat
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/mdlayher/netlink"
+	"github.com/rs/zerolog"
+	"golang.org/x/sys/unix"
+)
+
+// fib_rule_hdr and rtmsg have the same size
+const rtnetlinkHeaderLen = 12
+
+// setupNetlinkPolicyRouting sets up the same policy routing as setupPolicyRouting via rtnetlink, so that the ip command is not required
+func setupNetlinkPolicyRouting(logger zerolog.Logger) error {
+	conn, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return fmt.Errorf("failed to open rtnetlink connection: %w", err)
+	}
+	defer conn.Close()
+
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		return err
+	}
+
+	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		if err := addNetlinkPolicyRouting(conn, family, uint32(lo.Index)); err != nil {
+			if family == unix.AF_INET6 {
+				logger.Warn().Err(err).Msg("Failed to set up IPv6 policy routing, so IPv6 UDP datagrams are not redirected")
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func addNetlinkPolicyRouting(conn *netlink.Conn, family uint8, lo uint32) error {
+	found, err := hasNetlinkMessage(conn, unix.RTM_GETRULE, family, isTproxyRule)
+	if err != nil {
+		return fmt.Errorf("failed to list routing rules: %w", err)
+	}
+	if !found {
+		if _, err := conn.Execute(tproxyRuleMessage(family)); err != nil {
+			return fmt.Errorf("failed to add a routing rule: %w", err)
+		}
+	}
+	if _, err := conn.Execute(tproxyRouteMessage(family, lo)); err != nil {
+		return fmt.Errorf("failed to add a route to loopback: %w", err)
+	}
+	return nil
+}
+
+// verifyNetlinkPolicyRouting checks the IPv4 rule and route set up by setupNetlinkPolicyRouting
+func verifyNetlinkPolicyRouting() []string {
+	var ruleFound, routeFound bool
+	conn, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err == nil {
+		defer conn.Close()
+		ruleFound, _ = hasNetlinkMessage(conn, unix.RTM_GETRULE, unix.AF_INET, isTproxyRule)
+		routeFound, _ = hasNetlinkMessage(conn, unix.RTM_GETROUTE, unix.AF_INET, isTproxyRoute)
+	}
+
+	var drifts []string
+	if !ruleFound {
+		drifts = append(drifts, fmt.Sprintf("routing rule for fwmark %d is missing", tproxyMark))
+	}
+	if !routeFound {
+		drifts = append(drifts, fmt.Sprintf("route to loopback in table %d is missing", tproxyTable))
+	}
+	return drifts
+}
+
+// hasNetlinkMessage dumps rules or routes of family and returns true if any of them matches
+func hasNetlinkMessage(conn *netlink.Conn, typ uint16, family uint8, match func(netlink.Message) bool) (bool, error) {
+	header := make([]byte, rtnetlinkHeaderLen)
+	header[0] = family
+	msgs, err := conn.Execute(netlink.Message{
+		Header: netlink.Header{Type: netlink.HeaderType(typ), Flags: netlink.Request | netlink.Dump},
+		Data:   header,
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, m := range msgs {
+		if match(m) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// tproxyRuleMessage is "ip rule add fwmark <tproxyMark> lookup <tproxyTable>"
+func tproxyRuleMessage(family uint8) netlink.Message {
+	ae := netlink.NewAttributeEncoder()
+	ae.Uint32(unix.FRA_FWMARK, tproxyMark)
+	ae.Uint32(unix.FRA_TABLE, tproxyTable)
+	attrs, _ := ae.Encode()
+
+	// the table in the header is unspecified since tproxyTable does not fit in it
+	header := make([]byte, rtnetlinkHeaderLen)
+	header[0] = family
+	header[7] = unix.FR_ACT_TO_TBL
+
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:  unix.RTM_NEWRULE,
+			Flags: netlink.Request | netlink.Acknowledge | netlink.Create | netlink.Excl,
+		},
+		Data: append(header, attrs...),
+	}
+}
+
+// tproxyRouteMessage is "ip route replace local default dev lo table <tproxyTable>"
+func tproxyRouteMessage(family uint8, lo uint32) netlink.Message {
+	ae := netlink.NewAttributeEncoder()
+	ae.Uint32(unix.RTA_TABLE, tproxyTable)
+	ae.Uint32(unix.RTA_OIF, lo)
+	attrs, _ := ae.Encode()
+
+	header := make([]byte, rtnetlinkHeaderLen)
+	header[0] = family
+	header[5] = unix.RTPROT_BOOT
+	header[6] = unix.RT_SCOPE_HOST
+	header[7] = unix.RTN_LOCAL
+
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:  unix.RTM_NEWROUTE,
+			Flags: netlink.Request | netlink.Acknowledge | netlink.Create | netlink.Replace,
+		},
+		Data: append(header, attrs...),
+	}
+}
+
+func isTproxyRule(m netlink.Message) bool {
+	if len(m.Data) < rtnetlinkHeaderLen || m.Data[7] != unix.FR_ACT_TO_TBL {
+		return false
+	}
+	attrs := netlinkUint32Attributes(m.Data[rtnetlinkHeaderLen:])
+	return attrs[unix.FRA_FWMARK] == tproxyMark && attrs[unix.FRA_TABLE] == tproxyTable
+}
+
+func isTproxyRoute(m netlink.Message) bool {
+	// a default route has no destination
+	if len(m.Data) < rtnetlinkHeaderLen || m.Data[1] != 0 || m.Data[7] != unix.RTN_LOCAL {
+		return false
+	}
+	attrs := netlinkUint32Attributes(m.Data[rtnetlinkHeaderLen:])
+	return attrs[unix.RTA_TABLE] == tproxyTable
+}
+
+// netlinkUint32Attributes returns values of 4-byte attributes by their type
+func netlinkUint32Attributes(b []byte) map[uint16]uint32 {
+	attrs := map[uint16]uint32{}
+	ad, err := netlink.NewAttributeDecoder(b)
+	if err != nil {
+		return attrs
+	}
+	for ad.Next() {
+		if len(ad.Bytes()) == 4 {
+			attrs[ad.Type()] = ad.Uint32()
+		}
+	}
+	return attrs
+}
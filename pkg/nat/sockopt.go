@@ -0,0 +1,65 @@
+package nat
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	SO_ORIGINAL_DST      = 80
+	IP6T_SO_ORIGINAL_DST = 80
+)
+
+// getOriginalDestination returns the destination of a connection before it
+// was redirected by netfilter
+func getOriginalDestination(conn *net.TCPConn) (string, *net.TCPConn, error) {
+	// https://gist.github.com/cannium/55ec625516a24da8f547aa2d93f49ecf
+	f, err := conn.File()
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+
+	ipv6 := false
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		ipv6 = true
+	}
+
+	var ip net.IP
+	var port uint16
+	if ipv6 {
+		// sockaddr_in6 is returned and IPv6MTUInfo is large enough to hold it
+		info, err := unix.GetsockoptIPv6MTUInfo(int(f.Fd()), unix.IPPROTO_IPV6, IP6T_SO_ORIGINAL_DST)
+		if err != nil {
+			return "", nil, err
+		}
+		ip = net.IP(info.Addr.Addr[:])
+		// Port is stored in network byte order
+		portBytes := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		port = binary.BigEndian.Uint16(portBytes[:])
+	} else {
+		// sockaddr_in is returned and IPv6Mreq is large enough to hold it
+		addr, err := unix.GetsockoptIPv6Mreq(int(f.Fd()), unix.IPPROTO_IP, SO_ORIGINAL_DST)
+		if err != nil {
+			return "", nil, err
+		}
+		ip = net.IPv4(addr.Multiaddr[4], addr.Multiaddr[5], addr.Multiaddr[6], addr.Multiaddr[7])
+		port = uint16(addr.Multiaddr[2])<<8 + uint16(addr.Multiaddr[3])
+	}
+
+	newConn, err := net.FileConn(f)
+	if err != nil {
+		return "", nil, err
+	}
+
+	newTCPConn, ok := newConn.(*net.TCPConn)
+	if !ok {
+		panic("BUG: not TCPConn")
+	}
+
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), newTCPConn, nil
+}
@@ -0,0 +1,205 @@
+package nat
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	IP_TRANSPARENT       = 19
+	IP_RECVORIGDSTADDR   = 20
+	IPV6_RECVORIGDSTADDR = 74
+	IPV6_TRANSPARENT     = 75
+)
+
+// Packets marked with tproxyMark are routed to the loopback interface by the policy routing
+// so that packets sent by local processes reach TPROXY rules in prerouting
+const (
+	tproxyMark  = 0x6d6c
+	tproxyTable = 27756
+)
+
+// tproxyProtocol is a protocol redirected with TPROXY and the port of its listener
+type tproxyProtocol struct {
+	name string
+	port int
+}
+
+// tproxyProtocols returns protocols redirected with TPROXY.
+// TCP is redirected with TPROXY only in TPROXY mode, and UDP whenever udpPort is not 0.
+func tproxyProtocols(tproxy bool, proxyPort int, udpPort int) []tproxyProtocol {
+	var protocols []tproxyProtocol
+	if tproxy {
+		protocols = append(protocols, tproxyProtocol{name: "tcp", port: proxyPort})
+	}
+	if udpPort > 0 {
+		protocols = append(protocols, tproxyProtocol{name: "udp", port: udpPort})
+	}
+	return protocols
+}
+
+// setupPolicyRouting routes packets marked with tproxyMark to the loopback interface.
+// The rule and the route are left on shutdown since they affect only marked packets and other mallet processes may use them.
+func setupPolicyRouting(logger zerolog.Logger, executor Executor) error {
+	mark := strconv.Itoa(tproxyMark)
+	table := strconv.Itoa(tproxyTable)
+	for _, family := range []string{"-4", "-6"} {
+		if err := addPolicyRouting(executor, family, mark, table); err != nil {
+			if family == "-6" {
+				logger.Warn().Err(err).Msg("Failed to set up IPv6 policy routing, so IPv6 UDP datagrams are not redirected")
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func addPolicyRouting(executor Executor, family string, mark string, table string) error {
+	rules, err := executor.Output(exec.Command("ip", family, "rule", "show", "fwmark", mark, "lookup", table))
+	if err != nil {
+		return fmt.Errorf("failed to list routing rules: %w", err)
+	}
+	if strings.TrimSpace(rules) == "" {
+		if err := executor.Run(exec.Command("ip", family, "rule", "add", "fwmark", mark, "lookup", table)); err != nil {
+			return fmt.Errorf("failed to add a routing rule: %w", err)
+		}
+	}
+	if err := executor.Run(exec.Command("ip", family, "route", "replace", "local", "default", "dev", "lo", "table", table)); err != nil {
+		return fmt.Errorf("failed to add a route to loopback: %w", err)
+	}
+	return nil
+}
+
+// verifyPolicyRouting checks the IPv4 rule and route set up by setupPolicyRouting.
+// IPv6 is not checked since its setup is allowed to fail.
+func verifyPolicyRouting(executor Executor) []string {
+	mark := strconv.Itoa(tproxyMark)
+	table := strconv.Itoa(tproxyTable)
+
+	var drifts []string
+	if rules, err := executor.Output(exec.Command("ip", "-4", "rule", "show", "fwmark", mark, "lookup", table)); err != nil || strings.TrimSpace(rules) == "" {
+		drifts = append(drifts, fmt.Sprintf("routing rule for fwmark %s is missing", mark))
+	}
+	if routes, err := executor.Output(exec.Command("ip", "-4", "route", "show", "table", table)); err != nil || !strings.Contains(routes, "local default dev lo") {
+		drifts = append(drifts, fmt.Sprintf("route to loopback in table %s is missing", table))
+	}
+	return drifts
+}
+
+// ListenTransparentTCP listens on addr for connections redirected by TPROXY.
+// The original destination of a connection is its local address.
+func ListenTransparentTCP(addr string) (*net.TCPListener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return setTransparent(c, network, false)
+		},
+	}
+	l, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return l.(*net.TCPListener), nil
+}
+
+// ListenTransparentUDP listens on addr for UDP packets redirected by TPROXY.
+// The original destination of each packet is returned by ReadFromUDPWithDestination.
+func ListenTransparentUDP(addr string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return setTransparent(c, network, true)
+		},
+	}
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// DialTransparentUDP returns a socket bound to laddr, which is not a local address,
+// to reply to clients from the original destination of their packets
+func DialTransparentUDP(laddr *net.UDPAddr) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			if err := setTransparent(c, network, false); err != nil {
+				return err
+			}
+			var serr error
+			if err := c.Control(func(fd uintptr) {
+				serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+			}); err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	conn, err := lc.ListenPacket(context.Background(), "udp", laddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+func setTransparent(c syscall.RawConn, network string, recvOrigDst bool) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if strings.HasSuffix(network, "6") {
+			serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, IPV6_TRANSPARENT, 1)
+			if serr == nil && recvOrigDst {
+				serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, IPV6_RECVORIGDSTADDR, 1)
+			}
+			return
+		}
+		serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, IP_TRANSPARENT, 1)
+		if serr == nil && recvOrigDst {
+			serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, IP_RECVORIGDSTADDR, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// ReadFromUDPWithDestination reads a packet and returns its source and original destination
+func ReadFromUDPWithDestination(conn *net.UDPConn, b []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	oob := make([]byte, 1024)
+	n, oobn, _, src, err := conn.ReadMsgUDP(b, oob)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	for _, msg := range msgs {
+		// the data is sockaddr_in or sockaddr_in6 and the port is in network byte order
+		switch {
+		case msg.Header.Level == unix.IPPROTO_IP && msg.Header.Type == IP_RECVORIGDSTADDR && len(msg.Data) >= 8:
+			dst := &net.UDPAddr{
+				IP:   net.IPv4(msg.Data[4], msg.Data[5], msg.Data[6], msg.Data[7]),
+				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
+			}
+			return n, src, dst, nil
+		case msg.Header.Level == unix.IPPROTO_IPV6 && msg.Header.Type == IPV6_RECVORIGDSTADDR && len(msg.Data) >= 24:
+			dst := &net.UDPAddr{
+				IP:   net.IP(append([]byte{}, msg.Data[8:24]...)),
+				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
+			}
+			return n, src, dst, nil
+		}
+	}
+
+	return 0, nil, nil, StateNotFoundError
+}
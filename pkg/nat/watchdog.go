@@ -0,0 +1,95 @@
+package nat
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/ryotarai/mallet/pkg/metrics"
+)
+
+// Watchdog is NAT which verifies installed rules periodically and repairs them when they drift,
+// e.g. when a firewall manager flushes tables.
+// Verification and RedirectSubnets are serialized so that the latter is not seen as drift.
+type Watchdog struct {
+	NAT
+
+	logger    zerolog.Logger
+	mu        sync.Mutex
+	stopCh    chan struct{}
+	stoppedCh chan struct{}
+}
+
+func NewWatchdog(logger zerolog.Logger, nat NAT) *Watchdog {
+	return &Watchdog{
+		NAT:       nat,
+		logger:    logger,
+		stopCh:    make(chan struct{}),
+		stoppedCh: make(chan struct{}),
+	}
+}
+
+func (w *Watchdog) RedirectSubnets(subnets []string, excludes []string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.NAT.RedirectSubnets(subnets, excludes)
+}
+
+// Start verifies rules every interval until Stop is called
+func (w *Watchdog) Start(interval time.Duration) {
+	defer close(w.stoppedCh)
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			if err := w.check(); err != nil {
+				metrics.NATRuleRepairErrors.Inc()
+				w.logger.Warn().Err(err).Msg("Failed to verify NAT rules")
+			}
+		case <-w.stopCh:
+			return
+		}
+	}
+}
+
+// Stop stops verification. It must be called before Shutdown so that deleted rules are not repaired.
+func (w *Watchdog) Stop() {
+	close(w.stopCh)
+	<-w.stoppedCh
+}
+
+func (w *Watchdog) check() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	drifts, err := w.NAT.Verify()
+	if err != nil {
+		return err
+	}
+	if len(drifts) == 0 {
+		return nil
+	}
+
+	metrics.NATRuleDrifts.Inc()
+	w.logger.Warn().Strs("drifts", drifts).Msg("NAT rules have drifted, installing them again")
+
+	if err := w.NAT.Repair(); err != nil {
+		return err
+	}
+
+	drifts, err = w.NAT.Verify()
+	if err != nil {
+		return err
+	}
+	if len(drifts) > 0 {
+		w.logger.Warn().Strs("drifts", drifts).Msg("NAT rules still differ after repair")
+		return nil
+	}
+
+	w.logger.Info().Msg("Repaired NAT rules")
+	return nil
+}
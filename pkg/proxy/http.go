@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ryotarai/mallet/pkg/metrics"
+)
+
+// hopHeaders are removed when a request or a response is forwarded
+// https://tools.ietf.org/html/rfc7230#section-6.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// StartHTTP listens on addr and serves as an HTTP proxy.
+// It supports CONNECT method and requests with absolute URIs.
+// Destinations not routed to tunnels are connected directly if direct is true, and rejected otherwise.
+func (p *Proxy) StartHTTP(addr string, direct bool) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen TCP: %w", err)
+	}
+	defer listener.Close()
+
+	p.Logger.Info().Msgf("HTTP proxy is listening on %s", listener.Addr().String())
+
+	transport := &http.Transport{
+		Proxy: nil,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return p.dialTracked(ctx, addr, direct)
+		},
+	}
+	defer transport.CloseIdleConnections()
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !p.startHandler() {
+				http.Error(w, "proxy is shutting down", http.StatusServiceUnavailable)
+				return
+			}
+			defer p.handlers.Done()
+
+			if r.Method == http.MethodConnect {
+				p.handleHTTPConnect(w, r, direct)
+			} else {
+				p.handleHTTPForward(w, r, transport)
+			}
+		}),
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				metrics.AcceptedConnections.Inc()
+			}
+		},
+	}
+
+	// connections kept alive are closed after the current request on shutdown
+	if !p.addListener(closerFunc(func() error {
+		server.SetKeepAlivesEnabled(false)
+		return listener.Close()
+	})) {
+		return nil
+	}
+
+	if err := server.Serve(listener); err != nil && !p.isClosing() {
+		return err
+	}
+	return nil
+}
+
+func (p *Proxy) handleHTTPConnect(w http.ResponseWriter, r *http.Request, direct bool) {
+	dest := r.Host
+	if _, _, err := net.SplitHostPort(dest); err != nil {
+		dest = net.JoinHostPort(dest, "443")
+	}
+
+	p.Logger.Debug().Str("src", r.RemoteAddr).Str("dst", dest).Msg("Starting HTTP CONNECT proxy")
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	remote, routeName, tunnelName, err := p.dial(r.Context(), dest, direct)
+	if err != nil {
+		p.Logger.Warn().Err(err).Str("dst", dest).Msg("Failed to connect")
+		http.Error(w, err.Error(), httpErrorStatus(err))
+		return
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		remote.Close()
+		p.Logger.Warn().Err(err).Msg("Failed to hijack HTTP connection")
+		return
+	}
+
+	p.addActiveConn(tunnelName, 1)
+	defer p.addActiveConn(tunnelName, -1)
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		conn.Close()
+		remote.Close()
+		return
+	}
+
+	// data sent right after the request may be buffered
+	p.relay(&bufferedConn{Conn: conn, r: rw.Reader}, remote, routeName, tunnelName)
+}
+
+func (p *Proxy) handleHTTPForward(w http.ResponseWriter, r *http.Request, transport http.RoundTripper) {
+	if !r.URL.IsAbs() {
+		http.Error(w, "request URI must be absolute", http.StatusBadRequest)
+		return
+	}
+
+	p.Logger.Debug().Str("src", r.RemoteAddr).Str("url", r.URL.String()).Msg("Forwarding HTTP request")
+
+	outReq := r.WithContext(r.Context())
+	outReq.Header = r.Header.Clone()
+	outReq.RequestURI = ""
+	removeHopHeaders(outReq.Header)
+
+	resp, err := transport.RoundTrip(outReq)
+	if err != nil {
+		p.Logger.Warn().Err(err).Str("url", r.URL.String()).Msg("Failed to forward HTTP request")
+		http.Error(w, err.Error(), httpErrorStatus(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	for k, vs := range resp.Header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		p.Logger.Debug().Err(err).Msg("error copying HTTP response body")
+	}
+}
+
+// httpErrorStatus returns 403 for destinations not allowed and 502 for the others
+func httpErrorStatus(err error) int {
+	if errors.Is(err, ErrNoRoute) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
+
+func removeHopHeaders(h http.Header) {
+	// headers listed in Connection are hop-by-hop too
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// dialTracked dials like dial and counts the connection as active until it is closed
+func (p *Proxy) dialTracked(ctx context.Context, addr string, direct bool) (net.Conn, error) {
+	conn, _, tunnelName, err := p.dial(ctx, addr, direct)
+	if err != nil {
+		return nil, err
+	}
+
+	p.addActiveConn(tunnelName, 1)
+	return &trackedConn{
+		Conn: conn,
+		onClose: func() {
+			p.addActiveConn(tunnelName, -1)
+		},
+	}, nil
+}
+
+// trackedConn calls onClose once when it is closed
+type trackedConn struct {
+	net.Conn
+	onClose func()
+	once    sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.onClose)
+	return err
+}
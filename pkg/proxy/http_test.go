@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestHTTP(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	tlsServer := httptest.NewTLSServer(handler)
+	defer tlsServer.Close()
+
+	cases := []struct {
+		name       string
+		server     *httptest.Server
+		direct     bool
+		routed     bool
+		wantStatus int // 0 if the proxy rejects CONNECT
+		wantDials  int
+	}{
+		{name: "routed", server: plain, routed: true, wantStatus: http.StatusOK, wantDials: 1},
+		{name: "unrouted", server: plain, wantStatus: http.StatusForbidden},
+		{name: "unrouted with direct", server: plain, direct: true, wantStatus: http.StatusOK},
+		{name: "CONNECT routed", server: tlsServer, routed: true, wantStatus: http.StatusOK, wantDials: 1},
+		{name: "CONNECT unrouted", server: tlsServer},
+		{name: "CONNECT unrouted with direct", server: tlsServer, direct: true, wantStatus: http.StatusOK},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			serverURL, err := url.Parse(c.server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ft := &fakeTunnel{remote: serverURL.Host}
+			p := newListenerProxy(t, ft)
+			listen := startListener(t, func(listen string) error {
+				return p.StartHTTP(listen, c.direct)
+			})
+
+			if c.routed {
+				_, port, _ := net.SplitHostPort(serverURL.Host)
+				serverURL.Host = net.JoinHostPort(routedHost, port)
+			}
+			client := &http.Client{
+				Transport: &http.Transport{
+					Proxy:           http.ProxyURL(&url.URL{Scheme: "http", Host: listen}),
+					TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+				},
+			}
+			defer client.CloseIdleConnections()
+
+			resp, err := client.Get(serverURL.String())
+			if c.wantStatus == 0 {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("CONNECT succeeded")
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, err := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if resp.StatusCode != c.wantStatus {
+					t.Fatalf("got status %d, want %d", resp.StatusCode, c.wantStatus)
+				}
+				if c.wantStatus == http.StatusOK && string(body) != "hello" {
+					t.Errorf("got %q", body)
+				}
+			}
+			if ft.dials != c.wantDials {
+				t.Errorf("tunnel is dialed %d times, want %d", ft.dials, c.wantDials)
+			}
+		})
+	}
+}
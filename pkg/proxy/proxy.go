@@ -2,66 +2,314 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	chclient "github.com/jpillora/chisel/client"
-	chshare "github.com/jpillora/chisel/share"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
+	"github.com/ryotarai/mallet/pkg/metrics"
 	"github.com/ryotarai/mallet/pkg/nat"
+	"github.com/ryotarai/mallet/pkg/route"
+	"github.com/ryotarai/mallet/pkg/tunnel"
 )
 
 type Proxy struct {
-	Logger       zerolog.Logger
-	nat          nat.NAT
-	chiselConfig *chclient.Config
-	chiselClient *chclient.Client
+	Logger   zerolog.Logger
+	nat      nat.NAT
+	tunnels  map[string]tunnel.Tunnel
+	routes   *route.Table
+	timeouts map[string]Timeouts // tunnel name (or route.Direct) -> timeouts
+	policies map[string]Policy   // tunnel name -> policy
+
+	healthMu sync.Mutex
+	health   map[string]tunnelHealth
+
+	mu          sync.Mutex
+	activeConns map[string]int // tunnel name -> number of connections
+	activeDests map[string]int // destination IP -> number of connections redirected by NAT
+	udpSessions map[string]*udpSession
+
+	closing    bool
+	shutdownCh chan struct{}  // closed by Shutdown
+	listeners  []io.Closer    // closed by Shutdown
+	handlers   sync.WaitGroup // handlers of accepted connections
+}
+
+// Stats is the number of active connections
+type Stats struct {
+	ActiveConnections          int            `json:"activeConnections"`
+	ActiveConnectionsByTunnels map[string]int `json:"activeConnectionsByTunnels"`
+}
+
+// Timeouts limits connections carried by a tunnel
+type Timeouts struct {
+	// Idle closes a connection when no data is transferred in either direction for the duration (0 to disable)
+	Idle time.Duration
+	// Lifetime closes a connection when the duration passes after it is established (0 to disable)
+	Lifetime time.Duration
+	// Keepalive is the interval of TCP keepalive probes on the accepted socket (0 for the default of Go, negative to disable)
+	Keepalive time.Duration
+	// Connect is the timeout to connect or check the tunnel when the policy has another way to fall back on (0 to disable)
+	Connect time.Duration
+}
+
+// Policy decides how connections routed to a tunnel are made
+type Policy string
+
+const (
+	// PolicyTunnel connects via the tunnel only
+	PolicyTunnel Policy = "tunnel"
+	// PolicyDirect connects directly only
+	PolicyDirect Policy = "direct"
+	// PolicyTunnelThenDirect connects directly if the tunnel is unhealthy or fails to connect
+	PolicyTunnelThenDirect Policy = "tunnel-then-direct"
+	// PolicyDirectThenTunnel connects via the tunnel if it fails to connect directly
+	PolicyDirectThenTunnel Policy = "direct-then-tunnel"
+)
+
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case PolicyTunnel, PolicyDirect, PolicyTunnelThenDirect, PolicyDirectThenTunnel:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown policy %q (one of %s, %s, %s and %s)", s, PolicyTunnel, PolicyDirect, PolicyTunnelThenDirect, PolicyDirectThenTunnel)
 }
 
-func New(logger zerolog.Logger, nat nat.NAT, chiselConfig *chclient.Config) *Proxy {
+// healthCheckInterval is the duration to reuse the result of checking a tunnel
+const healthCheckInterval = 5 * time.Second
+
+type tunnelHealth struct {
+	checkedAt time.Time
+	err       error
+}
+
+const (
+	timeoutReasonIdle     = "idle"
+	timeoutReasonLifetime = "lifetime"
+)
+
+// New returns Proxy. Connections routed to a tunnel without a policy are made via the tunnel.
+func New(logger zerolog.Logger, nat nat.NAT, tunnels map[string]tunnel.Tunnel, routes *route.Table, timeouts map[string]Timeouts, policies map[string]Policy) *Proxy {
 	return &Proxy{
-		Logger:       logger.With().Str("component", "proxy").Logger(),
-		nat:          nat,
-		chiselConfig: chiselConfig,
+		Logger:   logger.With().Str("component", "proxy").Logger(),
+		nat:      nat,
+		tunnels:  tunnels,
+		routes:   routes,
+		timeouts: timeouts,
+		policies: policies,
+		health:   map[string]tunnelHealth{},
+
+		activeConns: map[string]int{},
+		activeDests: map[string]int{},
+		udpSessions: map[string]*udpSession{},
+		shutdownCh:  make(chan struct{}),
 	}
 }
 
-func (p *Proxy) Start(host string, port int) error {
-	// chisel
-	c, err := chclient.NewClient(p.chiselConfig)
-	if err != nil {
-		return err
+// Stats returns the number of connections being proxied
+func (p *Proxy) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := Stats{ActiveConnectionsByTunnels: map[string]int{}}
+	for name, n := range p.activeConns {
+		stats.ActiveConnections += n
+		stats.ActiveConnectionsByTunnels[name] = n
+	}
+	return stats
+}
+
+// Tunnels returns tunnels keyed by name
+func (p *Proxy) Tunnels() map[string]tunnel.Tunnel {
+	return p.tunnels
+}
+
+func (p *Proxy) addActiveConn(tunnel string, delta int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.activeConns[tunnel] += delta
+	metrics.ActiveConnections.WithLabelValues(tunnel).Add(float64(delta))
+	if p.activeConns[tunnel] == 0 {
+		delete(p.activeConns, tunnel)
 	}
-	p.chiselClient = c
+}
+
+func (p *Proxy) addActiveDest(ip string, delta int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	logLevel := p.Logger.GetLevel()
-	if logLevel == zerolog.DebugLevel || logLevel == zerolog.TraceLevel {
-		p.chiselClient.Logger.Debug = true
+	p.activeDests[ip] += delta
+	if p.activeDests[ip] == 0 {
+		delete(p.activeDests, ip)
 	}
+}
 
-	if err := p.chiselClient.Start(context.TODO()); err != nil {
-		return err
+// HasActiveConns returns true if connections redirected to ip are being proxied
+func (p *Proxy) HasActiveConns(ip net.IP) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.activeDests[ip.String()] > 0
+}
+
+// addListener registers l to be closed by Shutdown. It returns false if the proxy is shutting down.
+func (p *Proxy) addListener(l io.Closer) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closing {
+		return false
+	}
+	p.listeners = append(p.listeners, l)
+	return true
+}
+
+// startHandler counts a handler of an accepted connection, which must call p.handlers.Done when it finishes.
+// It returns false if the proxy is shutting down.
+func (p *Proxy) startHandler() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Add is not called after Wait in Shutdown starts
+	if p.closing {
+		return false
 	}
+	p.handlers.Add(1)
+	return true
+}
 
+func (p *Proxy) isClosing() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.closing
+}
+
+// Shutdown stops accepting connections and waits for connections being proxied to finish until ctx is done.
+// Tunnels are closed after that, so connections still open are broken.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closing {
+		close(p.shutdownCh)
+	}
+	p.closing = true
+	listeners := p.listeners
+	var sessions []*udpSession
+	for _, s := range p.udpSessions {
+		sessions = append(sessions, s)
+	}
+	p.mu.Unlock()
+
+	for _, l := range listeners {
+		if err := l.Close(); err != nil {
+			p.Logger.Debug().Err(err).Msg("Failed to close listener")
+		}
+	}
+	// UDP flows have no end, so they are not waited for
+	for _, s := range sessions {
+		s.close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.handlers.Wait()
+		close(done)
+	}()
+
+	var err error
+	if n := p.Stats().ActiveConnections; n > 0 {
+		p.Logger.Info().Int("connections", n).Msg("Waiting for connections to finish")
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("gave up waiting for connections: %w", ctx.Err())
+	}
+
+	for name, t := range p.tunnels {
+		if err := t.Close(); err != nil {
+			p.Logger.Warn().Err(err).Str("tunnel", name).Msg("Failed to close tunnel")
+		}
+	}
+
+	return err
+}
+
+// closerFunc is a function called as Close
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// StartTunnels starts all tunnels. This must be called before any listener is started.
+func (p *Proxy) StartTunnels() error {
+	for name, t := range p.tunnels {
+		if err := t.Start(context.TODO()); err != nil {
+			return fmt.Errorf("failed to start tunnel %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Start listens for connections redirected by NAT.
+// If transparent is true, listeners accept connections redirected by TPROXY.
+func (p *Proxy) Start(hosts []string, port int, transparent bool) error {
 	// listen
-	addr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("%s:%d", host, port))
-	if err != nil {
-		return fmt.Errorf("failed to resolve address: %w", err)
+	var listeners []*net.TCPListener
+	for _, host := range hosts {
+		addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			return fmt.Errorf("failed to resolve address: %w", err)
+		}
+
+		var listener *net.TCPListener
+		if transparent {
+			listener, err = nat.ListenTransparentTCP(addr.String())
+		} else {
+			listener, err = net.ListenTCP("tcp", addr)
+		}
+		if err != nil {
+			if addr.IP.To4() == nil && len(hosts) > 1 {
+				// IPv6 may be disabled on the host
+				p.Logger.Warn().Err(err).Msgf("Failed to listen on %s, so IPv6 connections are not proxied", addr.String())
+				continue
+			}
+			return fmt.Errorf("failed to listen TCP: %w", err)
+		}
+		defer listener.Close()
+		if !p.addListener(listener) {
+			return nil
+		}
+
+		p.Logger.Info().Msgf("Listening on %s", addr.String())
+		listeners = append(listeners, listener)
 	}
 
-	listener, err := net.ListenTCP("tcp4", addr)
-	if err != nil {
-		return fmt.Errorf("failed to listen TCP: %w", err)
+	errCh := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener *net.TCPListener) {
+			errCh <- p.serve(listener)
+		}(listener)
 	}
-	defer listener.Close()
 
-	p.Logger.Info().Msgf("Listening on %s", addr.String())
+	return <-errCh
+}
 
+func (p *Proxy) serve(listener *net.TCPListener) error {
 	for {
 		conn, err := listener.AcceptTCP()
 		if err != nil {
+			if p.isClosing() {
+				return nil
+			}
 			if ne, ok := err.(net.Error); ok {
 				if ne.Temporary() {
 					p.Logger.Warn().Err(err).Msg("Failed to accept TCP")
@@ -70,20 +318,19 @@ func (p *Proxy) Start(host string, port int) error {
 			}
 			return err
 		}
+		metrics.AcceptedConnections.Inc()
 
+		if !p.startHandler() {
+			conn.Close()
+			return nil
+		}
 		go func(conn *net.TCPConn) {
+			defer p.handlers.Done()
 			if err := p.handleConn(conn); err != nil {
 				p.Logger.Warn().Err(err).Msg("Failed to handle TCP connection")
 			}
 		}(conn)
 	}
-
-	return nil
-}
-
-type readWriteCloser struct {
-	io.ReadCloser
-	io.Writer
 }
 
 func (p *Proxy) handleConn(conn *net.TCPConn) error {
@@ -91,6 +338,11 @@ func (p *Proxy) handleConn(conn *net.TCPConn) error {
 
 	dest, newConn, err := p.nat.GetNATDestination(conn)
 	if err != nil {
+		reason := "error"
+		if errors.Is(err, nat.StateNotFoundError) {
+			reason = "state_not_found"
+		}
+		metrics.NATLookupFailures.WithLabelValues(reason).Inc()
 		return err
 	}
 	conn = newConn
@@ -99,58 +351,370 @@ func (p *Proxy) handleConn(conn *net.TCPConn) error {
 	if addr := conn.RemoteAddr(); addr != nil {
 		srcAddr = addr.String()
 	}
-	p.Logger.Debug().Str("src", srcAddr).Str("dst", dest).Msg("Starting proxy")
-
-	// me -> chisel
-	pipeOutR, pipeOutW := io.Pipe()
-	// chisel -> me
-	pipeInR, pipeInW := io.Pipe()
 
-	host, port, err := net.SplitHostPort(dest)
+	tunnelName, t, err := p.tunnelFor(dest)
 	if err != nil {
 		return err
 	}
+	p.Logger.Debug().Str("src", srcAddr).Str("dst", dest).Str("tunnel", tunnelName).Msg("Starting proxy")
 
-	proxy := p.chiselClient.CreateTCPProxy(0, &chshare.Remote{
-		RemoteHost: host,
-		RemotePort: port,
-		LocalIO: &readWriteCloser{
-			ReadCloser: pipeOutR,
-			Writer:     pipeInW,
-		},
-	})
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	if err := proxy.Start(ctx); err != nil {
+	// the resolver keeps redirecting the destination while the connection is open
+	destIP, _, _ := net.SplitHostPort(dest)
+	destIP = net.ParseIP(destIP).String()
+	p.addActiveDest(destIP, 1)
+	defer p.addActiveDest(destIP, -1)
+
+	remote, via, err := p.dialRoute(context.Background(), tunnelName, t, dest)
+	if err != nil {
 		return err
 	}
 
+	p.addActiveConn(via, 1)
+	defer p.addActiveConn(via, -1)
+
+	p.relay(conn, remote, tunnelName, via)
+
+	return nil
+}
+
+func (p *Proxy) dialTunnel(ctx context.Context, tunnelName string, t tunnel.Tunnel, dest string) (net.Conn, error) {
+	remote, err := t.Dial(ctx, dest)
+	if err != nil {
+		metrics.TunnelDialFailures.WithLabelValues(tunnelName).Inc()
+		return nil, err
+	}
+	return remote, nil
+}
+
+// relay copies data between local and remote until both sides finish sending or either side fails or times out,
+// and closes both. EOF from one side is propagated to the other as a half-close.
+// Timeouts are the ones of routeName, the tunnel of the route (or route.Direct), even if remote is connected via another one.
+// Metrics are recorded with tunnelName, which remote is connected via.
+func (p *Proxy) relay(conn net.Conn, remote net.Conn, routeName string, tunnelName string) {
+	defer conn.Close()
+	defer remote.Close()
+
+	startedAt := time.Now()
+	defer func() {
+		metrics.ConnectionDuration.WithLabelValues(tunnelName).Observe(time.Since(startedAt).Seconds())
+	}()
+
+	timeouts := p.timeouts[routeName]
+	if err := setKeepalive(conn, timeouts.Keepalive); err != nil {
+		p.Logger.Debug().Err(err).Msg("Failed to set TCP keepalive")
+	}
+
+	activity := &activity{}
+	activity.touch()
+	done := make(chan struct{})
+	defer close(done)
+	go p.watchTimeouts(conn, remote, tunnelName, timeouts, activity, done)
+
 	var wg sync.WaitGroup
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 
-		if _, err := io.Copy(pipeOutW, conn); err != nil {
+		w := &countingWriter{Writer: remote, counter: metrics.TransferredBytes.WithLabelValues(tunnelName, metrics.DirectionLocalToRemote), activity: activity}
+		if _, err := io.Copy(w, conn); err != nil {
 			p.Logger.Debug().Err(err).Msg("error copying data from local to remote")
+			remote.Close() // stop remote->local
+			return
 		}
 		p.Logger.Debug().Msg("local->remote copy done")
-		pipeInR.Close() // stop remote->local
+		if err := closeWrite(remote); err != nil {
+			p.Logger.Debug().Err(err).Msg("error closing remote for writing")
+		}
 	}()
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 
-		if _, err := io.Copy(conn, pipeInR); err != nil {
+		w := &countingWriter{Writer: conn, counter: metrics.TransferredBytes.WithLabelValues(tunnelName, metrics.DirectionRemoteToLocal), activity: activity}
+		if _, err := io.Copy(w, remote); err != nil {
 			p.Logger.Debug().Err(err).Msg("error copying data from remote to local")
+			conn.Close() // stop local->remote
+			return
 		}
-
 		p.Logger.Debug().Msg("remote->local copy done")
-		pipeOutW.Close()
+		if err := closeWrite(conn); err != nil {
+			p.Logger.Debug().Err(err).Msg("error closing local for writing")
+		}
 	}()
 
 	wg.Wait()
+}
 
-	return nil
+// watchTimeouts closes conn and remote when they are idle or live longer than timeouts, until done is closed
+func (p *Proxy) watchTimeouts(conn net.Conn, remote net.Conn, tunnelName string, timeouts Timeouts, activity *activity, done chan struct{}) {
+	if timeouts.Idle <= 0 && timeouts.Lifetime <= 0 {
+		return
+	}
+
+	// nil channels never receive
+	var idleTimer *time.Timer
+	var idleCh, lifetimeCh <-chan time.Time
+	if timeouts.Idle > 0 {
+		idleTimer = time.NewTimer(timeouts.Idle)
+		defer idleTimer.Stop()
+		idleCh = idleTimer.C
+	}
+	if timeouts.Lifetime > 0 {
+		lifetimeTimer := time.NewTimer(timeouts.Lifetime)
+		defer lifetimeTimer.Stop()
+		lifetimeCh = lifetimeTimer.C
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-lifetimeCh:
+			p.timeout(conn, remote, tunnelName, timeoutReasonLifetime)
+			return
+		case <-idleCh:
+			// the timer is reset by the remaining duration instead of on every write
+			if idle := activity.idle(); idle < timeouts.Idle {
+				idleTimer.Reset(timeouts.Idle - idle)
+				continue
+			}
+			p.timeout(conn, remote, tunnelName, timeoutReasonIdle)
+			return
+		}
+	}
+}
+
+// timeout closes conn and remote, which stops relay
+func (p *Proxy) timeout(conn net.Conn, remote net.Conn, tunnelName string, reason string) {
+	metrics.TimedOutConnections.WithLabelValues(tunnelName, reason).Inc()
+	p.Logger.Info().Str("src", conn.RemoteAddr().String()).Str("tunnel", tunnelName).Str("reason", reason).Msg("Closing timed out connection")
+
+	conn.Close()
+	remote.Close()
+}
+
+// closeWrite sends EOF to the peer of conn while data from the peer is still read.
+// Connections which cannot be half-closed are closed entirely.
+func closeWrite(conn net.Conn) error {
+	if b, ok := conn.(*bufferedConn); ok {
+		conn = b.Conn
+	}
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return conn.Close()
+}
+
+// setKeepalive sets TCP keepalive of the accepted socket under conn
+func setKeepalive(conn net.Conn, period time.Duration) error {
+	if b, ok := conn.(*bufferedConn); ok {
+		conn = b.Conn
+	}
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if period < 0 {
+		return tc.SetKeepAlive(false)
+	}
+	if period == 0 {
+		// accepted sockets already have keepalive of the default period
+		return nil
+	}
+	if err := tc.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return tc.SetKeepAlivePeriod(period)
+}
+
+// ErrNoRoute is returned by dial when no route matches the destination and direct connections are not allowed
+var ErrNoRoute = errors.New("no route to the destination")
+
+// dial connects to addr (host:port) via the tunnel of the matching route.
+// If no route matches or the destination is excluded, it connects directly if direct is true and returns ErrNoRoute otherwise.
+// It returns the tunnel of the route and the one which the connection is made via, or route.Direct for each of them.
+func (p *Proxy) dial(ctx context.Context, addr string, direct bool) (net.Conn, string, string, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	var r route.Route
+	var found bool
+	if ip := net.ParseIP(host); ip != nil {
+		r, found = p.routes.Lookup(ip)
+	} else if r, found = p.routes.LookupHost(host); !found {
+		// route by resolved addresses for hostnames not in targets
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, "", "", err
+		}
+		for _, ip := range ips {
+			if r, found = p.routes.Lookup(ip.IP); found {
+				break
+			}
+		}
+	}
+
+	if !found {
+		if !direct {
+			return nil, "", "", fmt.Errorf("%s: %w", addr, ErrNoRoute)
+		}
+		conn, err := p.dialDirect(ctx, addr)
+		return conn, route.Direct, route.Direct, err
+	}
+
+	t, ok := p.tunnels[r.Tunnel]
+	if !ok {
+		return nil, "", "", fmt.Errorf("tunnel %s is not found", r.Tunnel)
+	}
+
+	conn, via, err := p.dialRoute(ctx, r.Tunnel, t, addr)
+	return conn, r.Tunnel, via, err
+}
+
+// dialRoute connects to dest routed to the tunnel in the way of the policy of the tunnel.
+// It returns the name of the tunnel, or route.Direct for a direct connection.
+func (p *Proxy) dialRoute(ctx context.Context, tunnelName string, t tunnel.Tunnel, dest string) (net.Conn, string, error) {
+	timeout := p.timeouts[tunnelName].Connect
+
+	switch p.policies[tunnelName] {
+	case PolicyDirect:
+		conn, err := p.dialDirect(ctx, dest)
+		return conn, route.Direct, err
+	case PolicyTunnelThenDirect:
+		// the tunnel is checked first so that connections do not wait for an unreachable tunnel to time out
+		if err := p.checkTunnel(ctx, tunnelName, t, timeout); err != nil {
+			p.Logger.Debug().Err(err).Str("tunnel", tunnelName).Str("dst", dest).Msg("Tunnel is unhealthy, connecting directly")
+			conn, err := p.dialDirect(ctx, dest)
+			return conn, route.Direct, err
+		}
+
+		dialCtx, cancel := connectContext(ctx, timeout)
+		conn, err := p.dialTunnel(dialCtx, tunnelName, t, dest)
+		cancel()
+		if err == nil {
+			return conn, tunnelName, nil
+		}
+		p.setTunnelHealth(tunnelName, err)
+		p.Logger.Debug().Err(err).Str("tunnel", tunnelName).Str("dst", dest).Msg("Failed to connect via the tunnel, connecting directly")
+
+		conn, err = p.dialDirect(ctx, dest)
+		return conn, route.Direct, err
+	case PolicyDirectThenTunnel:
+		dialCtx, cancel := connectContext(ctx, timeout)
+		conn, err := p.dialDirect(dialCtx, dest)
+		cancel()
+		if err == nil {
+			return conn, route.Direct, nil
+		}
+		p.Logger.Debug().Err(err).Str("tunnel", tunnelName).Str("dst", dest).Msg("Failed to connect directly, connecting via the tunnel")
+	}
+
+	conn, err := p.dialTunnel(ctx, tunnelName, t, dest)
+	return conn, tunnelName, err
+}
+
+// dialDirect connects to addr without a tunnel.
+// Its packets are marked so that they are not redirected back to the proxy even if addr is redirected.
+func (p *Proxy) dialDirect(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	if p.nat != nil {
+		d.Control = nat.BypassControl
+	}
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// checkTunnel returns the error of Check of the tunnel, which is cached for healthCheckInterval
+func (p *Proxy) checkTunnel(ctx context.Context, tunnelName string, t tunnel.Tunnel, timeout time.Duration) error {
+	p.healthMu.Lock()
+	h, ok := p.health[tunnelName]
+	p.healthMu.Unlock()
+	if ok && time.Since(h.checkedAt) < healthCheckInterval {
+		return h.err
+	}
+
+	checkCtx, cancel := connectContext(ctx, timeout)
+	defer cancel()
+
+	err := t.Check(checkCtx)
+	p.setTunnelHealth(tunnelName, err)
+	return err
+}
+
+func (p *Proxy) setTunnelHealth(tunnelName string, err error) {
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+
+	h, ok := p.health[tunnelName]
+	wasHealthy := !ok || h.err == nil
+	if wasHealthy && err != nil {
+		p.Logger.Warn().Err(err).Str("tunnel", tunnelName).Msg("Tunnel is unhealthy, falling back on direct connections")
+	} else if !wasHealthy && err == nil {
+		p.Logger.Info().Str("tunnel", tunnelName).Msg("Tunnel is healthy again")
+	}
+	p.health[tunnelName] = tunnelHealth{checkedAt: time.Now(), err: err}
+}
+
+// connectContext returns ctx with timeout, or without it if timeout is 0
+func connectContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// tunnelFor returns the tunnel of the most specific route for dest
+func (p *Proxy) tunnelFor(dest string) (string, tunnel.Tunnel, error) {
+	host, _, err := net.SplitHostPort(dest)
+	if err != nil {
+		return "", nil, err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", nil, fmt.Errorf("invalid destination: %s", dest)
+	}
+
+	r, ok := p.routes.Lookup(ip)
+	if !ok {
+		return "", nil, fmt.Errorf("no route to %s", dest)
+	}
+
+	t, ok := p.tunnels[r.Tunnel]
+	if !ok {
+		return "", nil, fmt.Errorf("tunnel %s is not found", r.Tunnel)
+	}
+
+	return r.Tunnel, t, nil
+}
+
+// countingWriter counts written bytes so that metrics of long-lived connections are updated while copying
+type countingWriter struct {
+	io.Writer
+	counter  prometheus.Counter
+	activity *activity
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	w.counter.Add(float64(n))
+	w.activity.touch()
+	return n, err
+}
+
+// activity is when data is transferred last in either direction of a connection
+type activity struct {
+	lastUnixNano int64
+}
+
+func (a *activity) touch() {
+	atomic.StoreInt64(&a.lastUnixNano, time.Now().UnixNano())
+}
+
+func (a *activity) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&a.lastUnixNano)))
 }
@@ -0,0 +1,315 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/ryotarai/mallet/pkg/route"
+	"github.com/ryotarai/mallet/pkg/server"
+	"github.com/ryotarai/mallet/pkg/tunnel"
+)
+
+// startRequestServer starts a server which reads a request until EOF and then responds to it
+func startRequestServer(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := ioutil.ReadAll(conn)
+				if err != nil {
+					return
+				}
+				conn.Write(append([]byte("response to "), req...))
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// acceptedPair returns a client connection and the connection accepted for it
+func acceptedPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, err := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	accepted, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, accepted
+}
+
+// testHalfClose relays the connection accepted for a client to remote,
+// and checks that the response arrives after the client finishes sending the request
+func testHalfClose(t *testing.T, remote net.Conn) {
+	t.Helper()
+
+	client, accepted := acceptedPair(t)
+
+	p := &Proxy{Logger: zerolog.Nop()}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.relay(accepted, remote, "test", "test")
+	}()
+
+	if _, err := client.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "response to request" {
+		t.Errorf("got %q", resp)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("relay did not finish")
+	}
+}
+
+func TestRelayHalfCloseTCP(t *testing.T) {
+	addr := startRequestServer(t)
+
+	remote, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testHalfClose(t, remote)
+}
+
+func TestRelayHalfCloseChisel(t *testing.T) {
+	addr := startRequestServer(t)
+
+	s, err := server.New(zerolog.Nop(), server.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// find a free port for the server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverAddr := l.Addr().String()
+	l.Close()
+	if err := s.Start(serverAddr); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	c := tunnel.NewChisel(zerolog.Nop(), tunnel.ChiselConfig{
+		Server:        "http://" + serverAddr,
+		Fingerprint:   s.Fingerprint(),
+		MaxRetryCount: -1,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// streams cannot be opened until the client connects
+	for i := 0; ; i++ {
+		err := c.Check(ctx)
+		if err == nil {
+			break
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	remote, err := c.Dial(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testHalfClose(t, remote)
+}
+
+// fakeTunnel connects to remote (or destinations if empty), and fails Check and Dial with the errors if set
+type fakeTunnel struct {
+	remote   string
+	checkErr error
+	dialErr  error
+	dials    int
+}
+
+func (f *fakeTunnel) Start(ctx context.Context) error { return nil }
+func (f *fakeTunnel) Close() error                    { return nil }
+
+func (f *fakeTunnel) Check(ctx context.Context) error { return f.checkErr }
+
+func (f *fakeTunnel) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	f.dials++
+	if f.dialErr != nil {
+		return nil, f.dialErr
+	}
+	if f.remote != "" {
+		addr = f.remote
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+func TestDialRoutePolicies(t *testing.T) {
+	addr := startRequestServer(t)
+	unreachable := errors.New("unreachable")
+
+	cases := []struct {
+		name       string
+		policy     Policy
+		tunnel     fakeTunnel
+		dest       string
+		wantRoute  string
+		wantDials  int
+		wantFailed bool
+	}{
+		{name: "tunnel", policy: PolicyTunnel, dest: addr, wantRoute: "test", wantDials: 1},
+		{name: "tunnel unhealthy", policy: PolicyTunnel, tunnel: fakeTunnel{checkErr: unreachable, dialErr: unreachable}, dest: addr, wantDials: 1, wantFailed: true},
+		{name: "direct", policy: PolicyDirect, tunnel: fakeTunnel{dialErr: unreachable}, dest: addr, wantRoute: route.Direct},
+		{name: "tunnel-then-direct", policy: PolicyTunnelThenDirect, dest: addr, wantRoute: "test", wantDials: 1},
+		{name: "tunnel-then-direct unhealthy", policy: PolicyTunnelThenDirect, tunnel: fakeTunnel{checkErr: unreachable}, dest: addr, wantRoute: route.Direct},
+		{name: "tunnel-then-direct dial failure", policy: PolicyTunnelThenDirect, tunnel: fakeTunnel{dialErr: unreachable}, dest: addr, wantRoute: route.Direct, wantDials: 1},
+		{name: "direct-then-tunnel", policy: PolicyDirectThenTunnel, dest: addr, wantRoute: route.Direct},
+		{name: "direct-then-tunnel dial failure", policy: PolicyDirectThenTunnel, tunnel: fakeTunnel{remote: addr}, dest: closedAddr(t), wantRoute: "test", wantDials: 1},
+		{name: "direct-then-tunnel both failures", policy: PolicyDirectThenTunnel, tunnel: fakeTunnel{dialErr: unreachable}, dest: closedAddr(t), wantDials: 1, wantFailed: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := New(zerolog.Nop(), nil, nil, nil, nil, map[string]Policy{"test": c.policy})
+			ft := c.tunnel
+
+			conn, name, err := p.dialRoute(context.Background(), "test", &ft, c.dest)
+			if c.wantFailed {
+				if err == nil {
+					conn.Close()
+					t.Error("dialRoute succeeded")
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else {
+				conn.Close()
+				if name != c.wantRoute {
+					t.Errorf("connected via %q, want %q", name, c.wantRoute)
+				}
+			}
+			if ft.dials != c.wantDials {
+				t.Errorf("tunnel is dialed %d times, want %d", ft.dials, c.wantDials)
+			}
+		})
+	}
+}
+
+// closedAddr returns an address where no one listens
+func closedAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+// startRelay relays a client connection to a server connection with timeouts of the route to "test",
+// made via route.Direct which has no timeouts as if the route fell back on a direct connection
+func startRelay(t *testing.T, timeouts Timeouts) (*net.TCPConn, *net.TCPConn, chan struct{}) {
+	t.Helper()
+
+	client, accepted := acceptedPair(t)
+	remote, server := acceptedPair(t)
+
+	p := New(zerolog.Nop(), nil, nil, nil, map[string]Timeouts{"test": timeouts, route.Direct: {}}, nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.relay(accepted, remote, "test", route.Direct)
+	}()
+	return client, server, done
+}
+
+func TestRelayIdleTimeout(t *testing.T) {
+	client, _, done := startRelay(t, Timeouts{Idle: 200 * time.Millisecond})
+
+	// activity postpones the timeout
+	for i := 0; i < 4; i++ {
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("relay finished while the connection is active")
+	default:
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle connection is not closed")
+	}
+}
+
+func TestRelayLifetime(t *testing.T) {
+	client, _, done := startRelay(t, Timeouts{Lifetime: 300 * time.Millisecond})
+
+	startedAt := time.Now()
+	for {
+		select {
+		case <-done:
+			if d := time.Since(startedAt); d < 300*time.Millisecond {
+				t.Errorf("connection is closed after %s", d)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+			// the connection is closed even while it is active
+			client.Write([]byte("ping"))
+		}
+		if time.Since(startedAt) > 5*time.Second {
+			t.Fatal("connection is not closed after its lifetime")
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/ryotarai/mallet/pkg/metrics"
+)
+
+// SOCKS5 (RFC 1928) and username/password authentication (RFC 1929)
+const (
+	socksVersion         = 0x05
+	socksAuthVersion     = 0x01
+	socksMethodNoAuth    = 0x00
+	socksMethodPassword  = 0x02
+	socksMethodNoAccept  = 0xff
+	socksCmdConnect      = 0x01
+	socksAtypIPv4        = 0x01
+	socksAtypDomain      = 0x03
+	socksAtypIPv6        = 0x04
+	socksRepSucceeded    = 0x00
+	socksRepFailure      = 0x01
+	socksRepNotAllowed   = 0x02
+	socksRepCmdNotSupp   = 0x07
+	socksRepAtypNotSupp  = 0x08
+	socksAuthStatusOK    = 0x00
+	socksAuthStatusError = 0x01
+)
+
+var errSOCKSAuthFailed = errors.New("SOCKS authentication failed")
+
+// SOCKSAuth is a username and a password required by the SOCKS listener
+type SOCKSAuth struct {
+	Username string
+	Password string
+}
+
+// StartSOCKS listens on addr and serves SOCKS5 CONNECT requests.
+// If auth is nil, no authentication is required.
+// Destinations not routed to tunnels are connected directly if direct is true, and rejected otherwise.
+func (p *Proxy) StartSOCKS(addr string, auth *SOCKSAuth, direct bool) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen TCP: %w", err)
+	}
+	defer listener.Close()
+	if !p.addListener(listener) {
+		return nil
+	}
+
+	p.Logger.Info().Msgf("SOCKS5 proxy is listening on %s", listener.Addr().String())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if p.isClosing() {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok {
+				if ne.Temporary() {
+					p.Logger.Warn().Err(err).Msg("Failed to accept TCP")
+					continue
+				}
+			}
+			return err
+		}
+		metrics.AcceptedConnections.Inc()
+
+		if !p.startHandler() {
+			conn.Close()
+			return nil
+		}
+		go func(conn net.Conn) {
+			defer p.handlers.Done()
+			if err := p.handleSOCKSConn(conn, auth, direct); err != nil {
+				p.Logger.Warn().Err(err).Msg("Failed to handle SOCKS connection")
+			}
+		}(conn)
+	}
+}
+
+func (p *Proxy) handleSOCKSConn(conn net.Conn, auth *SOCKSAuth, direct bool) error {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	if err := socksNegotiate(r, conn, auth); err != nil {
+		return err
+	}
+
+	dest, err := socksReadRequest(r, conn)
+	if err != nil {
+		return err
+	}
+
+	p.Logger.Debug().Str("src", conn.RemoteAddr().String()).Str("dst", dest).Msg("Starting SOCKS proxy")
+
+	remote, routeName, tunnelName, err := p.dial(context.Background(), dest, direct)
+	if err != nil {
+		rep := byte(socksRepFailure)
+		if errors.Is(err, ErrNoRoute) {
+			rep = socksRepNotAllowed
+		}
+		socksReply(conn, rep)
+		return err
+	}
+
+	p.addActiveConn(tunnelName, 1)
+	defer p.addActiveConn(tunnelName, -1)
+
+	if err := socksReply(conn, socksRepSucceeded); err != nil {
+		remote.Close()
+		return err
+	}
+
+	// data sent right after the request may be buffered
+	p.relay(&bufferedConn{Conn: conn, r: r}, remote, routeName, tunnelName)
+
+	return nil
+}
+
+// socksNegotiate selects an authentication method and authenticates the client
+func socksNegotiate(r *bufio.Reader, w io.Writer, auth *SOCKSAuth) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if header[0] != socksVersion {
+		return fmt.Errorf("unsupported SOCKS version: %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return err
+	}
+
+	want := byte(socksMethodNoAuth)
+	if auth != nil {
+		want = socksMethodPassword
+	}
+
+	accepted := false
+	for _, m := range methods {
+		if m == want {
+			accepted = true
+			break
+		}
+	}
+	if !accepted {
+		w.Write([]byte{socksVersion, socksMethodNoAccept})
+		return fmt.Errorf("no acceptable SOCKS authentication method")
+	}
+
+	if _, err := w.Write([]byte{socksVersion, want}); err != nil {
+		return err
+	}
+
+	if auth == nil {
+		return nil
+	}
+
+	// username/password sub-negotiation
+	ver, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if ver != socksAuthVersion {
+		return fmt.Errorf("unsupported SOCKS authentication version: %d", ver)
+	}
+	username, err := readSOCKSString(r)
+	if err != nil {
+		return err
+	}
+	password, err := readSOCKSString(r)
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(username), []byte(auth.Username)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(password), []byte(auth.Password)) != 1 {
+		w.Write([]byte{socksAuthVersion, socksAuthStatusError})
+		return errSOCKSAuthFailed
+	}
+
+	_, err = w.Write([]byte{socksAuthVersion, socksAuthStatusOK})
+	return err
+}
+
+// socksReadRequest reads a request and returns the destination as host:port
+func socksReadRequest(r *bufio.Reader, w io.Writer) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version: %d", header[0])
+	}
+	if header[1] != socksCmdConnect {
+		socksReply(w, socksRepCmdNotSupp)
+		return "", fmt.Errorf("unsupported SOCKS command: %d", header[1])
+	}
+
+	var host string
+	switch header[3] {
+	case socksAtypIPv4:
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksAtypIPv6:
+		ip := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		domain, err := readSOCKSString(r)
+		if err != nil {
+			return "", err
+		}
+		host = domain
+	default:
+		socksReply(w, socksRepAtypNotSupp)
+		return "", fmt.Errorf("unsupported SOCKS address type: %d", header[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func socksReply(w io.Writer, rep byte) error {
+	// bound address is not meaningful for connections via tunnels
+	_, err := w.Write([]byte{socksVersion, rep, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func readSOCKSString(r *bufio.Reader) (string, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// bufferedConn reads from the buffered reader which wraps the conn
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/ryotarai/mallet/pkg/route"
+	"github.com/ryotarai/mallet/pkg/tunnel"
+)
+
+// routedHost is routed to the tunnel "test" in proxies returned by newListenerProxy
+const routedHost = "routed.test"
+
+// newListenerProxy returns Proxy which routes routedHost to the tunnel, and nothing else
+func newListenerProxy(t *testing.T, ft *fakeTunnel) *Proxy {
+	t.Helper()
+
+	routes := route.NewTable()
+	routes.Update([]route.Route{{Host: routedHost, Tunnel: "test"}}, nil)
+	p := New(zerolog.Nop(), nil, map[string]tunnel.Tunnel{"test": ft}, routes, nil, nil)
+	t.Cleanup(func() { p.Shutdown(context.Background()) })
+	return p
+}
+
+// startListener runs start on a free address and waits until it accepts connections
+func startListener(t *testing.T, start func(addr string) error) string {
+	t.Helper()
+
+	addr := closedAddr(t)
+	go start(addr)
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return addr
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// socksConnect sends a CONNECT request to dest via the SOCKS5 proxy and returns the reply code,
+// or socksRepNotAllowed if authentication fails
+func socksConnect(t *testing.T, addr string, auth *SOCKSAuth, dest string) (*net.TCPConn, byte) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	method := byte(socksMethodNoAuth)
+	if auth != nil {
+		method = socksMethodPassword
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp[1] != method {
+		t.Fatalf("method %d is selected", resp[1])
+	}
+
+	if auth != nil {
+		req := []byte{socksAuthVersion, byte(len(auth.Username))}
+		req = append(req, auth.Username...)
+		req = append(req, byte(len(auth.Password)))
+		req = append(req, auth.Password...)
+		if _, err := conn.Write(req); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp[1] != socksAuthStatusOK {
+			return conn.(*net.TCPConn), socksRepNotAllowed
+		}
+	}
+
+	host, portStr, err := net.SplitHostPort(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := []byte{socksVersion, socksCmdConnect, 0x00, socksAtypDomain, byte(len(host))}
+	req = append(req, host...)
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return conn.(*net.TCPConn), reply[1]
+}
+
+func TestSOCKS(t *testing.T) {
+	addr := startRequestServer(t)
+	_, port, _ := net.SplitHostPort(addr)
+	auth := &SOCKSAuth{Username: "user", Password: "pass"}
+
+	cases := []struct {
+		name       string
+		auth       *SOCKSAuth
+		clientAuth *SOCKSAuth
+		direct     bool
+		dest       string
+		wantRep    byte
+		wantDials  int
+	}{
+		{name: "routed", dest: net.JoinHostPort(routedHost, port), wantRep: socksRepSucceeded, wantDials: 1},
+		{name: "unrouted", dest: addr, wantRep: socksRepNotAllowed},
+		{name: "unrouted with direct", direct: true, dest: addr, wantRep: socksRepSucceeded},
+		{name: "auth", auth: auth, clientAuth: auth, dest: net.JoinHostPort(routedHost, port), wantRep: socksRepSucceeded, wantDials: 1},
+		{name: "wrong password", auth: auth, clientAuth: &SOCKSAuth{Username: "user", Password: "wrong"}, dest: net.JoinHostPort(routedHost, port), wantRep: socksRepNotAllowed},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ft := &fakeTunnel{remote: addr}
+			p := newListenerProxy(t, ft)
+			listen := startListener(t, func(listen string) error {
+				return p.StartSOCKS(listen, c.auth, c.direct)
+			})
+
+			conn, rep := socksConnect(t, listen, c.clientAuth, c.dest)
+			if rep != c.wantRep {
+				t.Fatalf("got reply %d, want %d", rep, c.wantRep)
+			}
+			if rep == socksRepSucceeded {
+				if _, err := conn.Write([]byte("request")); err != nil {
+					t.Fatal(err)
+				}
+				if err := conn.CloseWrite(); err != nil {
+					t.Fatal(err)
+				}
+				resp, err := ioutil.ReadAll(conn)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(resp) != "response to request" {
+					t.Errorf("got %q", resp)
+				}
+			}
+			if ft.dials != c.wantDials {
+				t.Errorf("tunnel is dialed %d times, want %d", ft.dials, c.wantDials)
+			}
+		})
+	}
+}
@@ -0,0 +1,288 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/ryotarai/mallet/pkg/metrics"
+	"github.com/ryotarai/mallet/pkg/nat"
+	"github.com/ryotarai/mallet/pkg/tunnel"
+)
+
+const (
+	udpDialTimeout = 10 * time.Second
+	// udpQueueSize is the number of datagrams queued while the tunnel is being dialed.
+	// Datagrams are dropped when the queue is full.
+	udpQueueSize = 64
+)
+
+// udpSession is a flow of datagrams between a client and a destination
+type udpSession struct {
+	key        string
+	src        *net.UDPAddr
+	dst        *net.UDPAddr
+	packets    chan []byte
+	done       chan struct{}
+	closeOnce  sync.Once
+	lastActive int64 // unix nano
+	// udpSize is the maximum size of DNS responses the client accepts
+	udpSize uint32
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive)))
+}
+
+func (s *udpSession) close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+// StartUDP listens for UDP datagrams redirected by TPROXY.
+// Datagrams are carried by the tunnel per flow (source and destination), and a flow is closed after idleTimeout.
+func (p *Proxy) StartUDP(hosts []string, port int, idleTimeout time.Duration) error {
+	var conns []*net.UDPConn
+	for _, host := range hosts {
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		conn, err := nat.ListenTransparentUDP(addr)
+		if err != nil {
+			if ip := net.ParseIP(host); ip != nil && ip.To4() == nil && len(hosts) > 1 {
+				p.Logger.Warn().Err(err).Msgf("Failed to listen on %s, so IPv6 datagrams are not proxied", addr)
+				continue
+			}
+			return fmt.Errorf("failed to listen UDP: %w", err)
+		}
+		defer conn.Close()
+		if !p.addListener(conn) {
+			return nil
+		}
+
+		p.Logger.Info().Msgf("Listening on %s/udp", addr)
+		conns = append(conns, conn)
+	}
+
+	go p.expireUDPSessions(idleTimeout)
+
+	errCh := make(chan error, len(conns))
+	for _, conn := range conns {
+		go func(conn *net.UDPConn) {
+			errCh <- p.serveUDP(conn)
+		}(conn)
+	}
+
+	return <-errCh
+}
+
+func (p *Proxy) serveUDP(conn *net.UDPConn) error {
+	buf := make([]byte, tunnel.MaxDatagramSize)
+	for {
+		n, src, dst, err := nat.ReadFromUDPWithDestination(conn, buf)
+		if err != nil {
+			if p.isClosing() {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				p.Logger.Warn().Err(err).Msg("Failed to read UDP")
+				continue
+			}
+			if err == nat.StateNotFoundError {
+				metrics.NATLookupFailures.WithLabelValues("state_not_found").Inc()
+				continue
+			}
+			return err
+		}
+
+		b := make([]byte, n)
+		copy(b, buf[:n])
+
+		s := p.udpSession(src, dst)
+		s.touch()
+		select {
+		case s.packets <- b:
+		case <-s.done:
+		default:
+			p.Logger.Debug().Str("src", src.String()).Str("dst", dst.String()).Msg("Dropped a datagram since the queue is full")
+		}
+	}
+}
+
+// udpSession returns the session of the flow, starting a new one if not found
+func (p *Proxy) udpSession(src *net.UDPAddr, dst *net.UDPAddr) *udpSession {
+	key := src.String() + "|" + dst.String()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if s, ok := p.udpSessions[key]; ok {
+		return s
+	}
+
+	s := &udpSession{
+		key:     key,
+		src:     src,
+		dst:     dst,
+		packets: make(chan []byte, udpQueueSize),
+		done:    make(chan struct{}),
+		udpSize: dns.MinMsgSize,
+	}
+	s.touch()
+	p.udpSessions[key] = s
+
+	go func() {
+		if err := p.handleUDPSession(s); err != nil {
+			p.Logger.Warn().Err(err).Str("src", src.String()).Str("dst", dst.String()).Msg("Failed to handle UDP flow")
+		}
+	}()
+
+	return s
+}
+
+func (p *Proxy) handleUDPSession(s *udpSession) error {
+	defer func() {
+		p.mu.Lock()
+		delete(p.udpSessions, s.key)
+		p.mu.Unlock()
+		s.close()
+	}()
+
+	dest := s.dst.String()
+	tunnelName, t, err := p.tunnelFor(dest)
+	if err != nil {
+		return err
+	}
+	p.Logger.Debug().Str("src", s.src.String()).Str("dst", dest).Str("tunnel", tunnelName).Msg("Starting UDP proxy")
+
+	metrics.ActiveUDPSessions.WithLabelValues(tunnelName).Inc()
+	defer metrics.ActiveUDPSessions.WithLabelValues(tunnelName).Dec()
+
+	destIP := s.dst.IP.String()
+	p.addActiveDest(destIP, 1)
+	defer p.addActiveDest(destIP, -1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), udpDialTimeout)
+	defer cancel()
+
+	// DNS queries are sent over TCP, whose framing is the same as the datagram stream, so they work with any tunnel
+	isDNS := s.dst.Port == 53
+	var remote net.Conn
+	if isDNS {
+		remote, err = p.dialTunnel(ctx, tunnelName, t, dest)
+	} else if ut, ok := t.(tunnel.UDPTunnel); ok {
+		remote, err = ut.DialUDP(ctx, dest)
+		if err != nil {
+			metrics.TunnelDialFailures.WithLabelValues(tunnelName).Inc()
+		}
+	} else {
+		return fmt.Errorf("tunnel %s does not support UDP except DNS", tunnelName)
+	}
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	// replies are sent from the original destination
+	reply, err := nat.DialTransparentUDP(s.dst)
+	if err != nil {
+		return fmt.Errorf("failed to bind %s: %w", dest, err)
+	}
+	defer reply.Close()
+
+	go func() {
+		defer s.close()
+
+		buf := make([]byte, tunnel.MaxDatagramSize)
+		for {
+			b, err := tunnel.ReadDatagram(remote, buf)
+			if err != nil {
+				return
+			}
+			if isDNS {
+				b = truncateDNSResponse(b, int(atomic.LoadUint32(&s.udpSize)))
+			}
+			if _, err := reply.WriteToUDP(b, s.src); err != nil {
+				p.Logger.Debug().Err(err).Msg("Failed to write UDP")
+				return
+			}
+			metrics.TransferredBytes.WithLabelValues(tunnelName, metrics.DirectionRemoteToLocal).Add(float64(len(b)))
+			s.touch()
+		}
+	}()
+
+	for {
+		select {
+		case b := <-s.packets:
+			if isDNS {
+				req := &dns.Msg{}
+				if err := req.Unpack(b); err == nil {
+					size := uint32(dns.MinMsgSize)
+					if opt := req.IsEdns0(); opt != nil && opt.UDPSize() > dns.MinMsgSize {
+						size = uint32(opt.UDPSize())
+					}
+					atomic.StoreUint32(&s.udpSize, size)
+				}
+			}
+			if err := tunnel.WriteDatagram(remote, b); err != nil {
+				return err
+			}
+			metrics.TransferredBytes.WithLabelValues(tunnelName, metrics.DirectionLocalToRemote).Add(float64(len(b)))
+		case <-s.done:
+			return nil
+		}
+	}
+}
+
+// expireUDPSessions closes sessions idle for idleTimeout until Shutdown is called
+func (p *Proxy) expireUDPSessions(idleTimeout time.Duration) {
+	if idleTimeout <= 0 {
+		return
+	}
+	interval := idleTimeout / 2
+	if interval <= 0 {
+		interval = idleTimeout
+	}
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			p.mu.Lock()
+			for _, s := range p.udpSessions {
+				if s.idle() >= idleTimeout {
+					s.close()
+				}
+			}
+			p.mu.Unlock()
+		case <-p.shutdownCh:
+			return
+		}
+	}
+}
+
+// truncateDNSResponse truncates a response received over TCP to the size the client accepts over UDP
+func truncateDNSResponse(b []byte, size int) []byte {
+	if len(b) <= size {
+		return b
+	}
+
+	resp := &dns.Msg{}
+	if err := resp.Unpack(b); err != nil {
+		return b
+	}
+	resp.Truncate(size)
+	truncated, err := resp.Pack()
+	if err != nil {
+		return b
+	}
+	return truncated
+}
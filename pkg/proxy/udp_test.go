@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestExpireUDPSessions(t *testing.T) {
+	p := New(zerolog.Nop(), nil, nil, nil, nil, nil)
+
+	idle := &udpSession{key: "idle", done: make(chan struct{})}
+	idle.touch()
+	active := &udpSession{key: "active", done: make(chan struct{})}
+	active.touch()
+	p.udpSessions[idle.key] = idle
+	p.udpSessions[active.key] = active
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		p.expireUDPSessions(200 * time.Millisecond)
+	}()
+
+	// keep one session active for longer than the timeout
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		active.touch()
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	select {
+	case <-idle.done:
+	default:
+		t.Error("idle session is not closed")
+	}
+	select {
+	case <-active.done:
+		t.Error("active session is closed")
+	default:
+	}
+
+	// Shutdown stops expiring sessions
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("expireUDPSessions did not return after Shutdown")
+	}
+}
+
+func TestExpireUDPSessionsWithoutTimeout(t *testing.T) {
+	p := New(zerolog.Nop(), nil, nil, nil, nil, nil)
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		p.expireUDPSessions(0)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("expireUDPSessions did not return without a timeout")
+	}
+}
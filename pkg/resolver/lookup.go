@@ -0,0 +1,131 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const lookupTimeout = 10 * time.Second
+
+// Exchanger sends a DNS query and returns the response
+type Exchanger interface {
+	Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
+}
+
+var errNoSuchHost = errors.New("no such host")
+
+// lookupIP returns addresses of the first name in names which has any, and the minimum TTL of them.
+// names are candidates for a hostname with the search list applied (see nameList).
+func lookupIP(ctx context.Context, e Exchanger, names []string) ([]net.IP, time.Duration, error) {
+	var lastErr error
+	for _, name := range names {
+		ips, ttl, err := lookupName(ctx, e, name)
+		if err == nil {
+			return ips, ttl, nil
+		}
+		if !errors.Is(err, errNoSuchHost) {
+			return nil, 0, err
+		}
+		lastErr = err
+	}
+	return nil, 0, lastErr
+}
+
+// lookupName returns IPv4 and IPv6 addresses of the fully qualified name and the minimum TTL of them
+func lookupName(ctx context.Context, e Exchanger, name string) ([]net.IP, time.Duration, error) {
+	var ips []net.IP
+	var ttl uint32
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+
+		resp, err := e.Exchange(ctx, req)
+		if err != nil {
+			return nil, 0, err
+		}
+		if resp.Rcode == dns.RcodeNameError {
+			return nil, 0, fmt.Errorf("lookup %s: %w", name, errNoSuchHost)
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			// some name servers fail for AAAA queries, in which case the host is regarded as IPv4 only
+			if qtype == dns.TypeAAAA && len(ips) > 0 {
+				break
+			}
+			return nil, 0, fmt.Errorf("lookup %s: %s", name, dns.RcodeToString[resp.Rcode])
+		}
+
+		for _, rr := range resp.Answer {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			default:
+				continue
+			}
+			if len(ips) == 0 || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+			ips = append(ips, ip)
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, 0, fmt.Errorf("lookup %s: %w", name, errNoSuchHost)
+	}
+
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// nameList returns names to query for host with search and ndots in conf, or host itself if conf is nil
+func nameList(conf *dns.ClientConfig, host string) []string {
+	if conf == nil {
+		return []string{dns.Fqdn(host)}
+	}
+	return conf.NameList(host)
+}
+
+// systemDNS queries name servers in /etc/resolv.conf directly so that TTLs of records are known
+type systemDNS struct {
+	servers []string
+	conf    *dns.ClientConfig
+}
+
+func newSystemDNS() (*systemDNS, error) {
+	conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return nil, err
+	}
+
+	d := &systemDNS{conf: conf}
+	for _, server := range conf.Servers {
+		d.servers = append(d.servers, net.JoinHostPort(server, conf.Port))
+	}
+	if len(d.servers) == 0 {
+		return nil, fmt.Errorf("no name server in /etc/resolv.conf")
+	}
+
+	return d, nil
+}
+
+func (d *systemDNS) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	var lastErr error
+	for _, server := range d.servers {
+		resp, _, err := (&dns.Client{Net: "udp"}).ExchangeContext(ctx, req, server)
+		if err == nil && resp.Truncated {
+			resp, _, err = (&dns.Client{Net: "tcp"}).ExchangeContext(ctx, req, server)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,147 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeExchanger answers queries with records in zone, and rcodes for names in failures
+type fakeExchanger struct {
+	zone     map[string][]dns.RR
+	failures map[string]int // "name type" to rcode
+	queries  []string
+}
+
+func newFakeExchanger(t *testing.T, records ...string) *fakeExchanger {
+	t.Helper()
+
+	e := &fakeExchanger{zone: map[string][]dns.RR{}, failures: map[string]int{}}
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.zone[rr.Header().Name] = append(e.zone[rr.Header().Name], rr)
+	}
+	return e
+}
+
+func (e *fakeExchanger) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	q := req.Question[0]
+	key := q.Name + " " + dns.TypeToString[q.Qtype]
+	e.queries = append(e.queries, key)
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	if rcode, ok := e.failures[key]; ok {
+		resp.Rcode = rcode
+		return resp, nil
+	}
+	rrs, ok := e.zone[q.Name]
+	if !ok {
+		resp.Rcode = dns.RcodeNameError
+		return resp, nil
+	}
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == q.Qtype {
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+	return resp, nil
+}
+
+func TestLookupIP(t *testing.T) {
+	e := newFakeExchanger(t,
+		"app.example.com. 300 IN A 192.0.2.1",
+		"app.example.com. 60 IN AAAA 2001:db8::1",
+	)
+
+	ips, ttl, err := lookupIP(context.Background(), e, []string{"app.example.com."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, ip := range ips {
+		got = append(got, ip.String())
+	}
+	if want := []string{"192.0.2.1", "2001:db8::1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if ttl != time.Minute {
+		t.Errorf("got TTL %s, want the minimum one", ttl)
+	}
+}
+
+func TestLookupIPSearch(t *testing.T) {
+	conf := &dns.ClientConfig{Search: []string{"corp.example.com", "example.com"}, Ndots: 1}
+	e := newFakeExchanger(t, "app.example.com. 300 IN A 192.0.2.1")
+
+	ips, _, err := lookupIP(context.Background(), e, nameList(conf, "app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("got %v", ips)
+	}
+
+	want := []string{"app.corp.example.com. A", "app.example.com. A", "app.example.com. AAAA"}
+	if !reflect.DeepEqual(e.queries, want) {
+		t.Errorf("got queries %v, want %v", e.queries, want)
+	}
+}
+
+func TestNameList(t *testing.T) {
+	conf := &dns.ClientConfig{Search: []string{"example.com"}, Ndots: 1}
+
+	cases := []struct {
+		conf *dns.ClientConfig
+		host string
+		want []string
+	}{
+		{conf: nil, host: "app", want: []string{"app."}},
+		{conf: conf, host: "app", want: []string{"app.example.com.", "app."}},
+		{conf: conf, host: "app.internal", want: []string{"app.internal.", "app.internal.example.com."}},
+		{conf: conf, host: "app.internal.", want: []string{"app.internal."}},
+	}
+
+	for _, c := range cases {
+		if got := nameList(c.conf, c.host); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("nameList(%q) = %v, want %v", c.host, got, c.want)
+		}
+	}
+}
+
+func TestLookupIPFailedAAAA(t *testing.T) {
+	e := newFakeExchanger(t, "app.example.com. 300 IN A 192.0.2.1")
+	e.failures["app.example.com. AAAA"] = dns.RcodeServerFailure
+
+	ips, _, err := lookupIP(context.Background(), e, []string{"app.example.com."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("got %v", ips)
+	}
+
+	// without IPv4 addresses, the failure is returned
+	e = newFakeExchanger(t, "app.example.com. 300 IN TXT \"no address\"")
+	e.failures["app.example.com. AAAA"] = dns.RcodeServerFailure
+	if _, _, err := lookupIP(context.Background(), e, []string{"app.example.com."}); err == nil {
+		t.Error("lookup succeeded without addresses")
+	}
+}
+
+func TestLookupIPFailure(t *testing.T) {
+	// a failure other than no such host does not fall through to the next name
+	e := newFakeExchanger(t, "app. 300 IN A 192.0.2.1")
+	e.failures["app.example.com. A"] = dns.RcodeRefused
+
+	if _, _, err := lookupIP(context.Background(), e, []string{"app.example.com.", "app."}); err == nil {
+		t.Error("lookup succeeded after a failure")
+	}
+}
@@ -1,37 +1,115 @@
 package resolver
 
 import (
+	"context"
 	"fmt"
 	"net"
-	"regexp"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/rs/zerolog"
+	"github.com/ryotarai/mallet/pkg/metrics"
 	"github.com/ryotarai/mallet/pkg/nat"
+	"github.com/ryotarai/mallet/pkg/route"
 )
 
 type Resolver struct {
+	mu             sync.Mutex
 	lastSubnets    []string
-	expire         map[string]time.Time
+	status         []SubnetStatus
+	expire         map[string]resolved
+	states         map[Target]*targetState
+	targets        []Target
+	interval       time.Duration
 	logger         zerolog.Logger
 	nat            nat.NAT
+	routes         *route.Table
+	conns          ActiveConns
+	ttl            TTLConfig
 	stopCh         chan struct{}
 	stoppedCh      chan struct{}
 	excludeSubnets []string
+	lookupers      map[string]Exchanger
+	system         Exchanger
+	dnsConfig      *dns.ClientConfig // search list applied to hostnames
 }
 
-var ipv4Regexp = regexp.MustCompile("\\A\\d+\\.\\d+\\.\\d+\\.\\d+(/\\d+)?\\z")
+// Target is a subnet or a hostname to be redirected to the tunnel.
+// A hostname may be a wildcard (e.g. *.example.com) whose addresses are learned only from DNS answers.
+type Target struct {
+	Address string
+	Tunnel  string
+}
+
+// IsHostname returns true if the target is a hostname or a wildcard, not a subnet
+func (t Target) IsHostname() bool {
+	return !isSubnet(t.Address)
+}
+
+// TTLConfig controls how often hostnames are resolved and how long their addresses are redirected
+type TTLConfig struct {
+	// MinTTL and MaxTTL clamp TTLs of DNS records
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// Retention is how long addresses are still redirected after their TTL passes
+	Retention time.Duration
+}
+
+// ActiveConns reports destinations which have open connections
+type ActiveConns interface {
+	HasActiveConns(ip net.IP) bool
+}
+
+// targetState is the result of resolving a hostname target
+type targetState struct {
+	refreshAt  time.Time
+	resolvedAt time.Time
+	addresses  []net.IP
+	failures   int
+	lastError  error
+}
 
-func New(logger zerolog.Logger, nat nat.NAT, excludeSubnets []string) *Resolver {
-	return &Resolver{
+type resolved struct {
+	tunnel   string
+	expireAt time.Time
+}
+
+// pruneInterval is how often learned subnets are checked for expiration
+const pruneInterval = 10 * time.Second
+
+// minRetryInterval is the interval to resolve a failed target again for the first time.
+// It is doubled on each failure up to the interval of Start.
+const minRetryInterval = 5 * time.Second
+
+// New returns a Resolver. Hostnames routed to a tunnel in lookupers are resolved by it instead of the local name servers.
+// Addresses which have connections in conns are kept redirected after they expire. conns may be nil.
+func New(logger zerolog.Logger, nat nat.NAT, routes *route.Table, excludeSubnets []string, lookupers map[string]Exchanger, ttl TTLConfig, conns ActiveConns) *Resolver {
+	r := &Resolver{
 		logger:         logger,
 		nat:            nat,
-		expire:         map[string]time.Time{},
+		routes:         routes,
+		conns:          conns,
+		ttl:            ttl,
+		expire:         map[string]resolved{},
+		states:         map[Target]*targetState{},
 		stopCh:         make(chan struct{}),
 		stoppedCh:      make(chan struct{}),
 		excludeSubnets: excludeSubnets,
+		lookupers:      lookupers,
 	}
+
+	if system, err := newSystemDNS(); err != nil {
+		// TTLs are unknown with the resolver of Go, so hostnames are resolved every interval
+		logger.Debug().Err(err).Msg("Name servers are not available, falling back to the resolver of Go")
+	} else {
+		r.system = system
+		r.dnsConfig = system.conf
+	}
+
+	return r
 }
 
 func (r *Resolver) Stop() {
@@ -39,83 +117,393 @@ func (r *Resolver) Stop() {
 	<-r.stoppedCh
 }
 
-func (r *Resolver) Start(interval time.Duration, targets []string) {
-	if err := r.update(targets); err != nil {
+// Start resolves hostnames in targets when their TTL passes.
+// Hostnames whose TTL is unknown are resolved every interval.
+func (r *Resolver) Start(interval time.Duration, targets []Target) {
+	r.mu.Lock()
+	r.targets = targets
+	r.interval = interval
+	err := r.apply()
+	r.mu.Unlock()
+	if err != nil {
+		metrics.ResolverUpdateErrors.Inc()
 		r.logger.Warn().Err(err).Msg("Failed to update subnets")
 	}
 
-	tick := time.Tick(interval)
+	pruneTick := time.NewTicker(pruneInterval)
+	defer pruneTick.Stop()
 	for {
+		next, err := r.update(targets)
+		if err != nil {
+			metrics.ResolverUpdateErrors.Inc()
+			r.logger.Warn().Err(err).Msg("Failed to update subnets")
+		}
+
+		timer := time.NewTimer(time.Until(next))
 		select {
-		case <-tick:
+		case <-timer.C:
+		case <-pruneTick.C:
+			timer.Stop()
+			if err := r.prune(); err != nil {
+				metrics.ResolverUpdateErrors.Inc()
+				r.logger.Warn().Err(err).Msg("Failed to delete expired subnets")
+			}
 		case <-r.stopCh:
+			timer.Stop()
 			close(r.stoppedCh)
 			return
 		}
-
-		if err := r.update(targets); err != nil {
-			r.logger.Warn().Err(err).Msg("Failed to update subnets")
-		}
 	}
 }
 
-func (r *Resolver) update(targets []string) error {
-	r.logger.Debug().Msg("Updating subnets")
+// ResolveOnce resolves hostnames in targets and redirects subnets once.
+// Hostnames which fail to be resolved are skipped with warnings.
+func (r *Resolver) ResolveOnce(targets []Target) error {
+	r.mu.Lock()
+	r.targets = targets
+	err := r.apply()
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	_, err = r.update(targets)
+	return err
+}
 
-	subnetsMap := map[string]struct{}{}
+// update resolves hostnames whose TTL has passed and returns when it should be called next.
+// Failed targets are retried with backoff and do not prevent the others from being redirected.
+func (r *Resolver) update(targets []Target) (time.Time, error) {
+	now := time.Now()
+	next := now.Add(r.interval)
 
+	r.mu.Lock()
+	var due []Target
 	for _, target := range targets {
-		if ipv4Regexp.MatchString(target) {
-			subnetsMap[target] = struct{}{}
-		} else {
-			ips, err := net.LookupIP(target)
-			if err != nil {
-				return err
+		if isSubnet(target.Address) || isWildcard(target.Address) {
+			continue
+		}
+		if state, ok := r.states[target]; ok && state.refreshAt.After(now) {
+			if state.refreshAt.Before(next) {
+				next = state.refreshAt
 			}
-			for _, ip := range ips {
-				ipv4 := ip.To4()
-				if ipv4 == nil {
-					continue
-				}
-				subnetsMap[fmt.Sprintf("%s/32", ipv4.String())] = struct{}{}
+			continue
+		}
+		due = append(due, target)
+	}
+	r.mu.Unlock()
+
+	if len(due) == 0 {
+		return next, nil
+	}
+
+	r.logger.Debug().Int("targets", len(due)).Msg("Updating subnets")
+
+	startedAt := time.Now()
+	defer func() {
+		metrics.ResolverUpdateDuration.Observe(time.Since(startedAt).Seconds())
+	}()
+
+	type result struct {
+		ips     []net.IP
+		refresh time.Duration
+		err     error
+	}
+	results := map[Target]result{}
+	for _, target := range due {
+		ips, refresh, err := r.resolve(target)
+		results[target] = result{ips: ips, refresh: refresh, err: err}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now = time.Now()
+	for target, res := range results {
+		state, ok := r.states[target]
+		if !ok {
+			state = &targetState{}
+			r.states[target] = state
+		}
+
+		if res.err != nil {
+			state.failures++
+			state.lastError = res.err
+			state.refreshAt = now.Add(r.retryInterval(state.failures))
+			metrics.ResolverUpdateErrors.Inc()
+			// addresses resolved before are kept until they expire
+			r.logger.Warn().Err(res.err).Str("target", target.Address).Int("failures", state.failures).Time("retryAt", state.refreshAt).Msg("Failed to resolve target")
+		} else {
+			if state.failures > 0 {
+				r.logger.Info().Str("target", target.Address).Int("failures", state.failures).Msg("Resolved target again")
 			}
+			state.failures = 0
+			state.lastError = nil
+			state.resolvedAt = now
+			state.addresses = res.ips
+			state.refreshAt = now.Add(res.refresh)
+			r.extend(target.Tunnel, res.ips, state.refreshAt.Add(r.ttl.Retention))
+		}
+
+		if state.refreshAt.Before(next) {
+			next = state.refreshAt
+		}
+	}
+
+	return next, r.apply()
+}
+
+// retryInterval returns the interval to resolve a target which failed failures times in a row
+func (r *Resolver) retryInterval(failures int) time.Duration {
+	d := minRetryInterval
+	for i := 1; i < failures && d < r.interval; i++ {
+		d *= 2
+	}
+	if d > r.interval {
+		d = r.interval
+	}
+	return d
+}
+
+// resolve returns addresses of the hostname target and how long they are valid for
+func (r *Resolver) resolve(target Target) ([]net.IP, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+
+	// the search list in /etc/resolv.conf applies to names resolved via tunnels as well
+	names := nameList(r.dnsConfig, target.Address)
+
+	if e, ok := r.lookupers[target.Tunnel]; ok {
+		ips, ttl, err := lookupIP(ctx, e, names)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to resolve %s via tunnel %s: %w", target.Address, target.Tunnel, err)
+		}
+		return ips, r.clampTTL(ttl), nil
+	}
+
+	if r.system != nil {
+		ips, ttl, err := lookupIP(ctx, r.system, names)
+		if err == nil {
+			return ips, r.clampTTL(ttl), nil
 		}
+		// the hostname may be in /etc/hosts
+		r.logger.Debug().Err(err).Str("target", target.Address).Msg("Falling back to the resolver of Go")
+	}
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", target.Address)
+	if err != nil {
+		return nil, 0, err
 	}
+	return ips, r.interval, nil
+}
 
-	// update expire time
-	expire := time.Now().Add(time.Hour)
-	for subnet := range subnetsMap {
-		r.expire[subnet] = expire
+func (r *Resolver) clampTTL(ttl time.Duration) time.Duration {
+	if r.ttl.MinTTL > 0 && ttl < r.ttl.MinTTL {
+		return r.ttl.MinTTL
+	}
+	if r.ttl.MaxTTL > 0 && ttl > r.ttl.MaxTTL {
+		return r.ttl.MaxTTL
+	}
+	return ttl
+}
+
+// extend redirects ips to the tunnel until expireAt. It returns true if any of ips is new. r.mu must be held.
+func (r *Resolver) extend(tunnel string, ips []net.IP, expireAt time.Time) bool {
+	added := false
+	for _, ip := range ips {
+		subnet := hostSubnet(ip)
+		res, found := r.expire[subnet]
+		if found && res.expireAt.After(expireAt) {
+			continue
+		}
+		r.expire[subnet] = resolved{tunnel: tunnel, expireAt: expireAt}
+		if !found {
+			added = true
+		}
+	}
+	return added
+}
+
+// Learn redirects ips to the tunnel until ttl and the retention pass.
+// It is called with addresses in DNS answers for hostnames in targets.
+func (r *Resolver) Learn(tunnel string, ips []net.IP, ttl time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.extend(tunnel, ips, time.Now().Add(ttl+r.ttl.Retention)) {
+		return nil
+	}
+
+	r.logger.Debug().Str("tunnel", tunnel).Interface("ips", ips).Dur("ttl", ttl).Msg("Learned addresses from DNS")
+	return r.apply()
+}
+
+// prune deletes expired subnets
+func (r *Resolver) prune() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for subnet, res := range r.expire {
+		if !res.expireAt.After(now) && !r.isPinned(subnet) {
+			return r.apply()
+		}
+	}
+
+	return nil
+}
+
+// isPinned returns true if the host subnet has open connections
+func (r *Resolver) isPinned(subnet string) bool {
+	if r.conns == nil {
+		return false
+	}
+	ip, _, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return false
+	}
+	return r.conns.HasActiveConns(ip)
+}
+
+// apply deletes expired subnets and redirects the rest. r.mu must be held.
+func (r *Resolver) apply() error {
+	var routes []route.Route
+	tunnels := map[string]string{} // subnet -> tunnel
+	literal := map[string]bool{}
+	for _, target := range r.targets {
+		if !isSubnet(target.Address) {
+			routes = append(routes, route.Route{Host: target.Address, Tunnel: target.Tunnel})
+			continue
+		}
+		tunnels[target.Address] = target.Tunnel
+		literal[target.Address] = true
 	}
 
 	// add not-expired subnets
-	// delete expired subnets
+	// delete expired subnets unless connections to them are open
 	now := time.Now()
-	for subnet, expireAt := range r.expire {
-		if expireAt.After(now) {
-			subnetsMap[subnet] = struct{}{}
-		} else {
-			delete(r.expire, subnet)
+	pinned := map[string]bool{}
+	for subnet, res := range r.expire {
+		if !res.expireAt.After(now) {
+			if !r.isPinned(subnet) {
+				delete(r.expire, subnet)
+				continue
+			}
+			pinned[subnet] = true
+		}
+		if _, ok := tunnels[subnet]; !ok {
+			tunnels[subnet] = res.tunnel
 		}
 	}
 
 	var subnets []string
-	for subnet := range subnetsMap {
+	for subnet := range tunnels {
 		subnets = append(subnets, subnet)
 	}
 	sort.Strings(subnets)
 
-	if r.areSubnetsUpdated(subnets) {
+	var status []SubnetStatus
+	for _, subnet := range subnets {
+		ipnet, err := route.ParseSubnet(subnet)
+		if err != nil {
+			return err
+		}
+		routes = append(routes, route.Route{Subnet: ipnet, Tunnel: tunnels[subnet]})
+
+		st := SubnetStatus{Subnet: subnet, Tunnel: tunnels[subnet]}
+		if !literal[subnet] {
+			st.ExpireAt = r.expire[subnet].expireAt
+			st.Pinned = pinned[subnet]
+		}
+		status = append(status, st)
+	}
+
+	var excludes []*net.IPNet
+	for _, subnet := range r.excludeSubnets {
+		ipnet, err := route.ParseSubnet(subnet)
+		if err != nil {
+			return err
+		}
+		excludes = append(excludes, ipnet)
+	}
+
+	// routes are updated before redirection so that redirected connections always find their tunnel
+	r.routes.Update(routes, excludes)
+
+	// nat is nil when packets are not redirected (e.g. only SOCKS listener is used)
+	if r.nat != nil && r.areSubnetsUpdated(subnets) {
 		if err := r.nat.RedirectSubnets(subnets, r.excludeSubnets); err != nil {
 			return err
 		}
 	}
 
 	r.lastSubnets = subnets
+	r.status = status
+	metrics.RedirectedSubnets.Set(float64(len(subnets)))
 
 	return nil
 }
 
+// SubnetStatus is a redirected subnet
+type SubnetStatus struct {
+	Subnet string `json:"subnet"`
+	Tunnel string `json:"tunnel"`
+	// ExpireAt is zero for subnets in targets
+	ExpireAt time.Time `json:"expireAt"`
+	// Pinned is true if the subnet has expired but is kept for open connections
+	Pinned bool `json:"pinned"`
+}
+
+// TargetStatus is the result of resolving a hostname target
+type TargetStatus struct {
+	Address    string    `json:"address"`
+	Tunnel     string    `json:"tunnel"`
+	Addresses  []string  `json:"addresses,omitempty"`
+	ResolvedAt time.Time `json:"resolvedAt,omitempty"`
+	NextAt     time.Time `json:"nextAt"`
+	Failures   int       `json:"failures,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// TargetStatus returns results of resolving hostname targets
+func (r *Resolver) TargetStatus() []TargetStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var targets []TargetStatus
+	for _, target := range r.targets {
+		state, ok := r.states[target]
+		if !ok {
+			continue
+		}
+
+		st := TargetStatus{
+			Address:    target.Address,
+			Tunnel:     target.Tunnel,
+			ResolvedAt: state.resolvedAt,
+			NextAt:     state.refreshAt,
+			Failures:   state.failures,
+		}
+		for _, ip := range state.addresses {
+			st.Addresses = append(st.Addresses, ip.String())
+		}
+		if state.lastError != nil {
+			st.Error = state.lastError.Error()
+		}
+		targets = append(targets, st)
+	}
+
+	return targets
+}
+
+// Status returns currently redirected subnets
+func (r *Resolver) Status() []SubnetStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.status
+}
+
 func (r *Resolver) areSubnetsUpdated(subnets []string) bool {
 	if len(r.lastSubnets) != len(subnets) {
 		return true
@@ -129,3 +517,23 @@ func (r *Resolver) areSubnetsUpdated(subnets []string) bool {
 
 	return false
 }
+
+// isSubnet returns true if the target is an IP address or a CIDR, not a hostname
+func isSubnet(target string) bool {
+	if _, _, err := net.ParseCIDR(target); err == nil {
+		return true
+	}
+	return net.ParseIP(target) != nil
+}
+
+// hostSubnet returns a subnet that contains only the IP address
+func hostSubnet(ip net.IP) string {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return fmt.Sprintf("%s/32", ipv4.String())
+	}
+	return fmt.Sprintf("%s/128", ip.String())
+}
+
+func isWildcard(target string) bool {
+	return strings.HasPrefix(target, "*.")
+}
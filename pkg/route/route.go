@@ -0,0 +1,141 @@
+package route
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Direct is the reserved tunnel name for connections made without a tunnel
+const Direct = "direct"
+
+// Route maps a subnet or a hostname to the tunnel which carries connections to it
+type Route struct {
+	// Subnet is nil for a hostname route
+	Subnet *net.IPNet
+	// Host is empty for a subnet route
+	Host   string
+	Tunnel string
+}
+
+// Table is a routing table looked up by longest prefix match
+type Table struct {
+	mu        sync.RWMutex
+	routes    []Route
+	hosts     map[string]Route
+	wildcards []Route
+	excludes  []*net.IPNet
+}
+
+func NewTable() *Table {
+	return &Table{
+		hosts: map[string]Route{},
+	}
+}
+
+// Update replaces all routes and excluded subnets in the table
+func (t *Table) Update(routes []Route, excludes []*net.IPNet) {
+	var sorted []Route
+	var wildcards []Route
+	hosts := map[string]Route{}
+	for _, r := range routes {
+		if r.Subnet == nil {
+			if strings.HasPrefix(r.Host, "*.") {
+				wildcards = append(wildcards, r)
+			} else {
+				hosts[normalizeHost(r.Host)] = r
+			}
+			continue
+		}
+		sorted = append(sorted, r)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, _ := sorted[i].Subnet.Mask.Size()
+		b, _ := sorted[j].Subnet.Mask.Size()
+		return a > b
+	})
+	// the longest suffix is the most specific
+	sort.SliceStable(wildcards, func(i, j int) bool {
+		return len(wildcards[i].Host) > len(wildcards[j].Host)
+	})
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.routes = sorted
+	t.hosts = hosts
+	t.wildcards = wildcards
+	t.excludes = excludes
+}
+
+// Lookup returns the most specific route containing ip.
+// Excluded subnets take precedence over any route.
+func (t *Table) Lookup(ip net.IP) (Route, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for _, subnet := range t.excludes {
+		if subnet.Contains(ip) {
+			return Route{}, false
+		}
+	}
+
+	for _, r := range t.routes {
+		if r.Subnet.Contains(ip) {
+			return r, true
+		}
+	}
+
+	return Route{}, false
+}
+
+// LookupHost returns the route for a hostname target.
+// An exact hostname takes precedence over wildcards.
+func (t *Table) LookupHost(host string) (Route, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if r, ok := t.hosts[normalizeHost(host)]; ok {
+		return r, true
+	}
+
+	for _, r := range t.wildcards {
+		if MatchHost(r.Host, host) {
+			return r, true
+		}
+	}
+
+	return Route{}, false
+}
+
+// MatchHost returns true if host matches pattern.
+// A pattern "*.example.com" matches any subdomain of example.com but not example.com itself.
+func MatchHost(pattern string, host string) bool {
+	pattern = normalizeHost(pattern)
+	host = normalizeHost(host)
+
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// ParseSubnet parses a CIDR or an IP address as a subnet
+func ParseSubnet(s string) (*net.IPNet, error) {
+	if _, subnet, err := net.ParseCIDR(s); err == nil {
+		return subnet, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, &net.ParseError{Type: "CIDR address", Text: s}
+	}
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return &net.IPNet{IP: ipv4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
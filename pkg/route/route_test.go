@@ -0,0 +1,149 @@
+package route
+
+import (
+	"net"
+	"testing"
+)
+
+func mustParseSubnet(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+
+	subnet, err := ParseSubnet(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return subnet
+}
+
+func TestTableLookup(t *testing.T) {
+	table := NewTable()
+	var routes []Route
+	for _, r := range []struct{ subnet, tunnel string }{
+		{"10.0.0.0/8", "wide"},
+		{"10.1.0.0/16", "narrow"},
+		{"10.1.2.3", "host"},
+		{"0.0.0.0/0", "default4"},
+		{"2001:db8::/32", "wide6"},
+		{"2001:db8:1::/48", "narrow6"},
+	} {
+		routes = append(routes, Route{Subnet: mustParseSubnet(t, r.subnet), Tunnel: r.tunnel})
+	}
+	table.Update(routes, []*net.IPNet{mustParseSubnet(t, "10.1.3.0/24")})
+
+	cases := []struct {
+		ip     string
+		tunnel string // empty if no route is found
+	}{
+		{"10.2.0.1", "wide"},
+		{"10.1.0.1", "narrow"},
+		{"10.1.2.3", "host"},
+		{"192.0.2.1", "default4"},
+		// excluded subnets take precedence over more specific routes
+		{"10.1.3.1", ""},
+		{"2001:db8:2::1", "wide6"},
+		{"2001:db8:1::1", "narrow6"},
+		// IPv4 routes do not match IPv6 addresses
+		{"2001:db9::1", ""},
+		// an IPv4-mapped address is looked up as IPv4
+		{"::ffff:10.1.0.1", "narrow"},
+	}
+
+	for _, c := range cases {
+		r, ok := table.Lookup(net.ParseIP(c.ip))
+		if c.tunnel == "" {
+			if ok {
+				t.Errorf("Lookup(%s) = %s, want no route", c.ip, r.Tunnel)
+			}
+			continue
+		}
+		if !ok || r.Tunnel != c.tunnel {
+			t.Errorf("Lookup(%s) = %s (found: %v), want %s", c.ip, r.Tunnel, ok, c.tunnel)
+		}
+	}
+}
+
+func TestTableLookupHost(t *testing.T) {
+	table := NewTable()
+	table.Update([]Route{
+		{Host: "*.example.com", Tunnel: "wildcard"},
+		{Host: "*.internal.example.com", Tunnel: "internal"},
+		{Host: "app.internal.example.com", Tunnel: "app"},
+		{Host: "Example.org.", Tunnel: "org"},
+	}, nil)
+
+	cases := []struct {
+		host   string
+		tunnel string // empty if no route is found
+	}{
+		{"www.example.com", "wildcard"},
+		{"db.internal.example.com", "internal"},
+		{"app.internal.example.com", "app"},
+		{"APP.internal.example.com.", "app"},
+		{"example.org", "org"},
+		// a wildcard does not match the domain itself
+		{"example.com", ""},
+		{"www.example.org", ""},
+	}
+
+	for _, c := range cases {
+		r, ok := table.LookupHost(c.host)
+		if c.tunnel == "" {
+			if ok {
+				t.Errorf("LookupHost(%s) = %s, want no route", c.host, r.Tunnel)
+			}
+			continue
+		}
+		if !ok || r.Tunnel != c.tunnel {
+			t.Errorf("LookupHost(%s) = %s (found: %v), want %s", c.host, r.Tunnel, ok, c.tunnel)
+		}
+	}
+}
+
+func TestMatchHost(t *testing.T) {
+	cases := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "badexample.com", false},
+		{"example.com", "EXAMPLE.COM.", true},
+		{"example.com", "www.example.com", false},
+	}
+
+	for _, c := range cases {
+		if got := MatchHost(c.pattern, c.host); got != c.want {
+			t.Errorf("MatchHost(%q, %q) = %v, want %v", c.pattern, c.host, got, c.want)
+		}
+	}
+}
+
+func TestParseSubnet(t *testing.T) {
+	cases := []struct {
+		s    string
+		want string // empty if invalid
+	}{
+		{"10.0.0.1/8", "10.0.0.0/8"},
+		{"10.0.0.1", "10.0.0.1/32"},
+		{"2001:db8::1", "2001:db8::1/128"},
+		{"2001:db8::/32", "2001:db8::/32"},
+		{"example.com", ""},
+		{"10.0.0.0/33", ""},
+	}
+
+	for _, c := range cases {
+		subnet, err := ParseSubnet(c.s)
+		if c.want == "" {
+			if err == nil {
+				t.Errorf("ParseSubnet(%q) = %s, want an error", c.s, subnet)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseSubnet(%q) failed: %v", c.s, err)
+		} else if subnet.String() != c.want {
+			t.Errorf("ParseSubnet(%q) = %s, want %s", c.s, subnet, c.want)
+		}
+	}
+}
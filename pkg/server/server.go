@@ -0,0 +1,477 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	chshare "github.com/jpillora/chisel/share"
+	"github.com/rs/zerolog"
+	"github.com/ryotarai/mallet/pkg/tunnel"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	configRequestTimeout = 10 * time.Second
+	dialTimeout          = 10 * time.Second
+	udpIdleTimeout       = 2 * time.Minute
+)
+
+// Config is the configuration of Server
+type Config struct {
+	// KeyFile is the path of the private key. It is generated if it does not exist so that the fingerprint does not change.
+	KeyFile string
+	// AuthFile is a users file in the format of chisel server
+	AuthFile string
+	// Auth is "user:pass" allowed to connect to any address
+	Auth string
+	// AllowSubnets restricts destinations (empty to allow all)
+	AllowSubnets []*net.IPNet
+}
+
+// Server is a chisel server compatible with the tunnel of mallet.
+// Unlike chisel server, destinations are checked for each connection since mallet opens them on demand.
+type Server struct {
+	logger      zerolog.Logger
+	config      Config
+	sshConfig   *ssh.ServerConfig
+	fingerprint string
+	users       *chshare.UserIndex
+	sessions    *chshare.Users
+	sessCount   int32
+	server      *http.Server
+	upgrader    websocket.Upgrader
+}
+
+func New(logger zerolog.Logger, config Config) (*Server, error) {
+	s := &Server{
+		logger:   logger.With().Str("component", "server").Logger(),
+		config:   config,
+		sessions: chshare.NewUsers(),
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			CheckOrigin:     func(r *http.Request) bool { return true },
+		},
+	}
+
+	s.users = chshare.NewUserIndex(chshare.NewLogger("server"))
+	if config.AuthFile != "" {
+		if err := s.users.LoadUsers(config.AuthFile); err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", config.AuthFile, err)
+		}
+	}
+	if config.Auth != "" {
+		u := &chshare.User{Addrs: []*regexp.Regexp{chshare.UserAllowAll}}
+		u.Name, u.Pass = chshare.ParseAuth(config.Auth)
+		if u.Name == "" {
+			return nil, fmt.Errorf("auth must be in the form of user:pass")
+		}
+		s.users.AddUser(u)
+	}
+
+	key, err := loadOrGenerateKey(config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	private, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	s.fingerprint = chshare.FingerprintKey(private.PublicKey())
+
+	s.sshConfig = &ssh.ServerConfig{
+		ServerVersion:    "SSH-" + chshare.ProtocolVersion + "-server",
+		PasswordCallback: s.authUser,
+	}
+	s.sshConfig.AddHostKey(private)
+
+	return s, nil
+}
+
+// Fingerprint returns the fingerprint of the key given to --chisel-fingerprint of clients
+func (s *Server) Fingerprint() string {
+	return s.fingerprint
+}
+
+// Start listens on addr and serves requests in background
+func (s *Server) Start(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	s.server = &http.Server{Handler: http.HandlerFunc(s.handleHTTP)}
+	go func() {
+		if err := s.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			s.logger.Error().Err(err).Msg("Server stopped")
+		}
+	}()
+
+	s.logger.Info().Str("fingerprint", s.fingerprint).Msgf("Listening on %s", addr)
+	if s.users.Len() == 0 {
+		s.logger.Warn().Msg("User authentication is disabled")
+	}
+	if len(s.config.AllowSubnets) == 0 {
+		s.logger.Warn().Msg("Connections to any destination are allowed")
+	}
+
+	return nil
+}
+
+func (s *Server) Stop() error {
+	if s.server == nil {
+		return nil
+	}
+	return s.server.Close()
+}
+
+func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request) {
+	upgrade := strings.ToLower(r.Header.Get("Upgrade"))
+	protocol := r.Header.Get("Sec-WebSocket-Protocol")
+	if upgrade == "websocket" && strings.HasPrefix(protocol, "chisel-") {
+		if protocol == chshare.ProtocolVersion {
+			s.handleWebsocket(w, r)
+			return
+		}
+		s.logger.Info().Msgf("Ignored client connection using protocol %s, expected %s", protocol, chshare.ProtocolVersion)
+	}
+
+	switch r.URL.Path {
+	case "/health":
+		w.Write([]byte("OK\n"))
+	case "/version":
+		w.Write([]byte(chshare.BuildVersion))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) handleWebsocket(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.With().Int32("session", atomic.AddInt32(&s.sessCount, 1)).Str("client", r.RemoteAddr).Logger()
+
+	wsConn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Debug().Err(err).Msg("Failed to upgrade")
+		return
+	}
+	conn := chshare.NewWebSocketConn(wsConn)
+
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.sshConfig)
+	if err != nil {
+		logger.Debug().Err(err).Msg("Failed to handshake")
+		conn.Close()
+		return
+	}
+	defer sshConn.Close()
+
+	var user *chshare.User
+	if s.users.Len() > 0 {
+		sid := string(sshConn.SessionID())
+		user, _ = s.sessions.Get(sid)
+		s.sessions.Del(sid)
+		logger = logger.With().Str("user", sshConn.User()).Logger()
+	}
+
+	// the client sends its config first
+	var req *ssh.Request
+	select {
+	case req = <-reqs:
+	case <-time.After(configRequestTimeout):
+		logger.Debug().Msg("Timed out waiting for config")
+		return
+	}
+	if req == nil {
+		return
+	}
+	if err := s.verifyConfig(req, user); err != nil {
+		logger.Warn().Err(err).Msg("Rejected client")
+		req.Reply(false, []byte(err.Error()))
+		return
+	}
+	req.Reply(true, nil)
+
+	logger.Info().Msg("Client connected")
+	go s.handleRequests(reqs)
+	go s.handleChannels(logger, chans, user)
+	sshConn.Wait()
+	logger.Info().Msg("Client disconnected")
+}
+
+func (s *Server) verifyConfig(req *ssh.Request, user *chshare.User) error {
+	if req.Type != "config" {
+		return errors.New("expecting config request")
+	}
+	c, err := chshare.DecodeConfig(req.Payload)
+	if err != nil {
+		return errors.New("invalid config")
+	}
+	if c.Version != chshare.BuildVersion {
+		s.logger.Debug().Msgf("Client version %s differs from server version %s", c.Version, chshare.BuildVersion)
+	}
+
+	for _, r := range c.Remotes {
+		if r.Reverse || r.Socks || r.Stdio {
+			return fmt.Errorf("remote %s is not supported", r)
+		}
+		if _, err := s.checkAccess(user, r.Remote()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) handleRequests(reqs <-chan *ssh.Request) {
+	for r := range reqs {
+		switch r.Type {
+		case "ping":
+			r.Reply(true, nil)
+		default:
+			r.Reply(false, nil)
+		}
+	}
+}
+
+func (s *Server) handleChannels(logger zerolog.Logger, chans <-chan ssh.NewChannel, user *chshare.User) {
+	for ch := range chans {
+		go s.handleChannel(logger, ch, user)
+	}
+}
+
+func (s *Server) handleChannel(logger zerolog.Logger, ch ssh.NewChannel, user *chshare.User) {
+	remote := string(ch.ExtraData())
+
+	// channels for UDP are opened by mallet with the prefix
+	network := "tcp"
+	if strings.HasPrefix(remote, tunnel.UDPPrefix) {
+		network = "udp"
+		remote = strings.TrimPrefix(remote, tunnel.UDPPrefix)
+	}
+
+	addr, err := s.checkAccess(user, remote)
+	if err != nil {
+		logger.Warn().Err(err).Msg("Denied connection")
+		ch.Reject(ssh.Prohibited, err.Error())
+		return
+	}
+
+	dst, err := net.DialTimeout(network, addr, dialTimeout)
+	if err != nil {
+		logger.Debug().Err(err).Str("remote", remote).Msg("Failed to connect")
+		ch.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	stream, reqs, err := ch.Accept()
+	if err != nil {
+		dst.Close()
+		logger.Debug().Err(err).Msg("Failed to accept channel")
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	logger.Debug().Str("network", network).Str("remote", remote).Msg("Open")
+	var sent, received int64
+	if network == "udp" {
+		sent, received = relayUDP(stream, dst)
+	} else {
+		sent, received = relayTCP(stream, dst)
+	}
+	logger.Debug().Str("network", network).Str("remote", remote).Int64("sent", sent).Int64("received", received).Msg("Close")
+}
+
+// relayTCP copies between stream and dst until both directions finish or either fails, and closes both.
+// EOF in one direction is passed on as a half-close so that the other direction keeps flowing.
+func relayTCP(stream ssh.Channel, dst net.Conn) (int64, int64) {
+	var sent, received int64
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		var err error
+		if sent, err = io.Copy(dst, stream); err != nil {
+			dst.Close() // stop reading from dst
+			return
+		}
+		closeWrite(dst)
+	}()
+
+	var err error
+	if received, err = io.Copy(stream, dst); err != nil {
+		stream.Close() // stop reading from stream
+	} else {
+		stream.CloseWrite()
+	}
+
+	wg.Wait()
+	stream.Close()
+	dst.Close()
+
+	return sent, received
+}
+
+func closeWrite(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return conn.Close()
+}
+
+// relayUDP relays datagrams framed in stream to dst and back
+// until either side fails or no datagram is relayed for udpIdleTimeout
+func relayUDP(stream io.ReadWriteCloser, dst net.Conn) (int64, int64) {
+	var sent, received int64
+	lastActive := time.Now().UnixNano()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, tunnel.MaxDatagramSize)
+		for {
+			b, err := tunnel.ReadDatagram(stream, buf)
+			if err != nil {
+				break
+			}
+			if _, err := dst.Write(b); err != nil {
+				break
+			}
+			atomic.AddInt64(&sent, int64(len(b)))
+			atomic.StoreInt64(&lastActive, time.Now().UnixNano())
+		}
+		dst.Close() // stop reading from dst
+	}()
+
+	buf := make([]byte, tunnel.MaxDatagramSize)
+	for {
+		dst.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		n, err := dst.Read(buf)
+		if err != nil {
+			// datagrams may be only sent
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&lastActive)))
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && idle < udpIdleTimeout {
+				continue
+			}
+			break
+		}
+		if err := tunnel.WriteDatagram(stream, buf[:n]); err != nil {
+			break
+		}
+		received += int64(n)
+		atomic.StoreInt64(&lastActive, time.Now().UnixNano())
+	}
+	stream.Close() // stop reading from stream
+	<-done
+
+	return atomic.LoadInt64(&sent), received
+}
+
+// checkAccess returns the address to connect to if the user is allowed to connect to remote (host:port).
+// If AllowSubnets is set, a hostname is resolved here and the allowed address is returned, so that it cannot resolve differently on dial.
+// Otherwise the hostname is returned as is and resolved on dial.
+func (s *Server) checkAccess(user *chshare.User, remote string) (string, error) {
+	host, port, err := splitRemote(remote)
+	if err != nil {
+		return "", err
+	}
+
+	if user != nil && !user.HasAccess(remote) && !user.HasAccess(net.JoinHostPort(host, port)) {
+		return "", fmt.Errorf("access to %s is denied for %s", remote, user.Name)
+	}
+
+	if len(s.config.AllowSubnets) == 0 {
+		return net.JoinHostPort(host, port), nil
+	}
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		defer cancel()
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return "", err
+		}
+		ips = nil
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+
+	for _, ip := range ips {
+		for _, subnet := range s.config.AllowSubnets {
+			if subnet.Contains(ip) {
+				return net.JoinHostPort(ip.String(), port), nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("access to %s is not allowed", remote)
+}
+
+// authUser validates the username and password
+func (s *Server) authUser(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	if s.users.Len() == 0 {
+		return nil, nil
+	}
+
+	user, found := s.users.Get(c.User())
+	if !found || user.Pass != string(password) {
+		s.logger.Debug().Str("user", c.User()).Msg("Login failed")
+		return nil, fmt.Errorf("invalid authentication for username: %s", c.User())
+	}
+	s.sessions.Set(string(c.SessionID()), user)
+
+	return nil, nil
+}
+
+// splitRemote splits host:port. Chisel clients join an IPv6 address and a port without brackets.
+func splitRemote(remote string) (string, string, error) {
+	if host, port, err := net.SplitHostPort(remote); err == nil {
+		return host, port, nil
+	}
+
+	i := strings.LastIndex(remote, ":")
+	if i < 0 || net.ParseIP(remote[:i]) == nil {
+		return "", "", fmt.Errorf("invalid remote: %s", remote)
+	}
+	return remote[:i], remote[i+1:], nil
+}
+
+// loadOrGenerateKey reads the private key in file, or generates and writes it if it does not exist.
+// A new key is generated every time if file is empty.
+func loadOrGenerateKey(file string) ([]byte, error) {
+	if file == "" {
+		return chshare.GenerateKey("")
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err == nil {
+		return b, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	b, err = chshare.GenerateKey("")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(file, b, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write private key: %w", err)
+	}
+
+	return b, nil
+}
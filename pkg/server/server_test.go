@@ -0,0 +1,161 @@
+package server
+
+import (
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	chshare "github.com/jpillora/chisel/share"
+	"github.com/ryotarai/mallet/pkg/tunnel"
+)
+
+// startUDPEcho starts a UDP server which sends datagrams back
+func startUDPEcho(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, tunnel.MaxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestRelayUDP(t *testing.T) {
+	dst, err := net.Dial("udp", startUDPEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, stream := net.Pipe()
+	type result struct{ sent, received int64 }
+	done := make(chan result, 1)
+	go func() {
+		sent, received := relayUDP(stream, dst)
+		done <- result{sent, received}
+	}()
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, tunnel.MaxDatagramSize)
+	for _, d := range []string{"first", "second datagram", "third"} {
+		if err := tunnel.WriteDatagram(client, []byte(d)); err != nil {
+			t.Fatal(err)
+		}
+		b, err := tunnel.ReadDatagram(client, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != d {
+			t.Errorf("got %q, want %q", b, d)
+		}
+	}
+
+	// closing the stream stops relaying
+	client.Close()
+	select {
+	case r := <-done:
+		if want := int64(len("first") + len("second datagram") + len("third")); r.sent != want || r.received != want {
+			t.Errorf("sent %d and received %d bytes, want %d", r.sent, r.received, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("relayUDP did not return after the stream was closed")
+	}
+}
+
+func TestSplitRemote(t *testing.T) {
+	cases := []struct {
+		remote string
+		host   string
+		port   string
+		err    bool
+	}{
+		{remote: "example.com:80", host: "example.com", port: "80"},
+		{remote: "10.0.0.1:80", host: "10.0.0.1", port: "80"},
+		{remote: "[2001:db8::1]:80", host: "2001:db8::1", port: "80"},
+		// chisel clients do not bracket IPv6 addresses
+		{remote: "2001:db8::1:80", host: "2001:db8::1", port: "80"},
+		{remote: "::1:443", host: "::1", port: "443"},
+		{remote: "example.com", err: true},
+		{remote: "example.com:80:80", err: true},
+	}
+
+	for _, c := range cases {
+		host, port, err := splitRemote(c.remote)
+		if c.err {
+			if err == nil {
+				t.Errorf("splitRemote(%q) succeeded", c.remote)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("splitRemote(%q) failed: %v", c.remote, err)
+			continue
+		}
+		if host != c.host || port != c.port {
+			t.Errorf("splitRemote(%q) = (%q, %q), want (%q, %q)", c.remote, host, port, c.host, c.port)
+		}
+	}
+}
+
+func TestCheckAccess(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// alice can connect only to port 80 and bob to any address
+	alice := &chshare.User{Name: "alice", Addrs: []*regexp.Regexp{regexp.MustCompile(`:80$`)}}
+	bob := &chshare.User{Name: "bob", Addrs: []*regexp.Regexp{chshare.UserAllowAll}}
+
+	cases := []struct {
+		name    string
+		user    *chshare.User
+		subnets []*net.IPNet
+		remote  string
+		want    string
+		err     bool
+	}{
+		{name: "no auth", remote: "10.0.0.1:22", want: "10.0.0.1:22"},
+		{name: "no auth with hostname", remote: "localhost:22", want: "localhost:22"},
+		{name: "allowed user", user: alice, remote: "10.0.0.1:80", want: "10.0.0.1:80"},
+		{name: "allowed user with unbracketed IPv6", user: alice, remote: "2001:db8::1:80", want: "[2001:db8::1]:80"},
+		{name: "denied user", user: alice, remote: "10.0.0.1:22", err: true},
+		{name: "allowed subnet", subnets: []*net.IPNet{subnet}, remote: "127.0.0.1:22", want: "127.0.0.1:22"},
+		{name: "denied subnet", subnets: []*net.IPNet{subnet}, remote: "10.0.0.1:22", err: true},
+		{name: "hostname in allowed subnet", subnets: []*net.IPNet{subnet}, remote: "localhost:22", want: "127.0.0.1:22"},
+		{name: "allowed user and subnet", user: bob, subnets: []*net.IPNet{subnet}, remote: "127.0.0.1:22", want: "127.0.0.1:22"},
+		{name: "allowed user in denied subnet", user: bob, subnets: []*net.IPNet{subnet}, remote: "10.0.0.1:22", err: true},
+		{name: "denied user in allowed subnet", user: alice, subnets: []*net.IPNet{subnet}, remote: "127.0.0.1:22", err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := &Server{config: Config{AllowSubnets: c.subnets}}
+			got, err := s.checkAccess(c.user, c.remote)
+			if c.err {
+				if err == nil {
+					t.Errorf("access to %s is allowed", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("got %s, want %s", got, c.want)
+			}
+		})
+	}
+}
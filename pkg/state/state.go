@@ -0,0 +1,225 @@
+package state
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ryotarai/mallet/pkg/nat"
+)
+
+// DefaultDir is the directory of state files used unless specified
+var DefaultDir = defaultDir()
+
+func defaultDir() string {
+	if runtime.GOOS == "darwin" {
+		return "/var/run/mallet"
+	}
+	return "/run/mallet"
+}
+
+// startTimeTolerance is the allowed difference of start times of the same process.
+// Start times on Linux are calculated from the boot time, which may shift slightly.
+const startTimeTolerance = 2 * time.Second
+
+// State is what a mallet process installed, recorded so that it is deleted exactly even after the process dies
+type State struct {
+	PID int `json:"pid"`
+	// StartedAt is the start time of the process, which distinguishes it from another process with the reused PID
+	StartedAt time.Time     `json:"startedAt"`
+	Backend   string        `json:"backend"`
+	RuleSets  []nat.RuleSet `json:"ruleSets"`
+}
+
+// New returns State of the current process
+func New(backend string, ruleSets []nat.RuleSet) (*State, error) {
+	pid := os.Getpid()
+	startedAt, err := processStartTime(pid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the start time of the process: %w", err)
+	}
+
+	return &State{
+		PID:       pid,
+		StartedAt: startedAt,
+		Backend:   backend,
+		RuleSets:  ruleSets,
+	}, nil
+}
+
+// ProcessExists returns true if a process with pid exists, regardless of which program it runs
+func ProcessExists(pid int) bool {
+	_, err := processStartTime(pid)
+	return err == nil
+}
+
+// IsRunning returns true if the process which wrote the state is still running
+func (s *State) IsRunning() bool {
+	startedAt, err := processStartTime(s.PID)
+	if err != nil {
+		return false
+	}
+	d := startedAt.Sub(s.StartedAt)
+	return -startTimeTolerance < d && d < startTimeTolerance
+}
+
+// Write writes the state to a file in dir named after the PID
+func Write(dir string, s *State) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filePath(dir, s.PID)
+	tmp := fmt.Sprintf("%s.tmp", path)
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Load reads all state files in dir. It returns no state if dir does not exist.
+func Load(dir string) ([]*State, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var states []*State
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		s := &State{}
+		if err := json.Unmarshal(b, s); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		states = append(states, s)
+	}
+
+	return states, nil
+}
+
+// Remove removes the state file of the process
+func Remove(dir string, pid int) error {
+	if err := os.Remove(filePath(dir, pid)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func filePath(dir string, pid int) string {
+	return filepath.Join(dir, fmt.Sprintf("%d.json", pid))
+}
+
+// processStartTime returns when the process started, in seconds precision
+func processStartTime(pid int) (time.Time, error) {
+	if runtime.GOOS == "linux" {
+		return linuxProcessStartTime(pid)
+	}
+
+	out, err := exec.Command("ps", "-o", "lstart=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.ParseInLocation("Mon Jan _2 15:04:05 2006", strings.TrimSpace(string(out)), time.Local)
+}
+
+// linuxProcessStartTime calculates the start time from the boot time and the 22nd field of /proc/PID/stat,
+// which is clock ticks since boot
+func linuxProcessStartTime(pid int) (time.Time, error) {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return time.Time{}, err
+	}
+	// the second field is the command name in parentheses, which may contain spaces
+	i := strings.LastIndexByte(string(stat), ')')
+	if i < 0 {
+		return time.Time{}, fmt.Errorf("invalid stat of process %d", pid)
+	}
+	fields := strings.Fields(string(stat[i+1:]))
+	if len(fields) < 20 {
+		return time.Time{}, fmt.Errorf("invalid stat of process %d", pid)
+	}
+	ticks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	bootTime, err := linuxBootTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	hz := linuxClockTicks()
+	return bootTime.Add(time.Duration(ticks/hz)*time.Second + time.Duration(ticks%hz)*time.Second/time.Duration(hz)), nil
+}
+
+// atClkTck is the type of the auxiliary vector entry of clock ticks per second
+const atClkTck = 17
+
+// linuxClockTicks returns clock ticks per second in /proc, which is AT_CLKTCK in the auxiliary vector
+// as sysconf(_SC_CLK_TCK) returns. It is 100 on most architectures.
+func linuxClockTicks() int64 {
+	auxv, err := ioutil.ReadFile("/proc/self/auxv")
+	if err != nil {
+		return 100
+	}
+
+	// the vector is pairs of a type and a value in native words
+	size := strconv.IntSize / 8
+	word := func(b []byte) uint64 {
+		if size == 4 {
+			return uint64(binary.NativeEndian.Uint32(b))
+		}
+		return binary.NativeEndian.Uint64(b)
+	}
+	for i := 0; i+2*size <= len(auxv); i += 2 * size {
+		if word(auxv[i:]) == atClkTck {
+			if hz := int64(word(auxv[i+size:])); hz > 0 {
+				return hz
+			}
+		}
+	}
+	return 100
+}
+
+func linuxBootTime() (time.Time, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "btime" {
+			sec, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(sec, 0), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Time{}, fmt.Errorf("btime is not found in /proc/stat")
+}
@@ -0,0 +1,74 @@
+package state
+
+import (
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ryotarai/mallet/pkg/nat"
+)
+
+func TestProcessStartTime(t *testing.T) {
+	startedAt, err := processStartTime(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the test binary has just started
+	if d := time.Since(startedAt); d < -startTimeTolerance || d > 5*time.Minute {
+		t.Errorf("start time %s is %s before now", startedAt, d)
+	}
+}
+
+func TestProcessExists(t *testing.T) {
+	if !ProcessExists(os.Getpid()) {
+		t.Error("the current process does not exist")
+	}
+
+	// the PID of a reaped child is not reused immediately
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skip(err)
+	}
+	if ProcessExists(cmd.Process.Pid) {
+		t.Errorf("exited process %d exists", cmd.Process.Pid)
+	}
+}
+
+func TestWriteLoad(t *testing.T) {
+	dir := t.TempDir()
+	ruleSets := []nat.RuleSet{{Command: "iptables", Table: "nat", Chain: "mallet-pid1"}}
+
+	s, err := New("iptables", ruleSets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.IsRunning() {
+		t.Error("state of the current process is not running")
+	}
+	if err := Write(dir, s); err != nil {
+		t.Fatal(err)
+	}
+
+	states, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 1 || !reflect.DeepEqual(states[0].RuleSets, ruleSets) || !states[0].IsRunning() {
+		t.Fatalf("loaded %+v", states)
+	}
+
+	// another process with the reused PID started later
+	states[0].StartedAt = states[0].StartedAt.Add(-time.Minute)
+	if states[0].IsRunning() {
+		t.Error("state with another start time is running")
+	}
+
+	if err := Remove(dir, s.PID); err != nil {
+		t.Fatal(err)
+	}
+	if states, err := Load(dir); err != nil || len(states) != 0 {
+		t.Errorf("loaded %v (%v) after removal", states, err)
+	}
+}
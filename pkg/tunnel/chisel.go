@@ -0,0 +1,428 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jpillora/backoff"
+	chshare "github.com/jpillora/chisel/share"
+	"github.com/rs/zerolog"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	chiselHandshakeTimeout     = 45 * time.Second
+	chiselSSHTimeout           = 30 * time.Second
+	defaultChiselRetryInterval = 5 * time.Minute
+)
+
+// ChiselConfig is the configuration of a chisel tunnel
+type ChiselConfig struct {
+	// Server is the URL of chisel server (http://, https://, ws:// or wss://)
+	Server string
+	// Fingerprint is the prefix of the fingerprint of the server key (any key is accepted if empty)
+	Fingerprint string
+	// Auth is "user:pass"
+	Auth string
+	// Keepalive is the interval of pings to the server (0 to disable)
+	Keepalive time.Duration
+	// MaxRetryCount is the number of reconnections before giving up (negative for unlimited)
+	MaxRetryCount int
+	// MaxRetryInterval is the maximum interval of reconnections
+	MaxRetryInterval time.Duration
+	// Proxy is the URL of an HTTP CONNECT or SOCKS5 (socks:// or socks5h://) proxy to the server
+	Proxy string
+	// Hostname is the Host header sent to the server
+	Hostname string
+}
+
+// Chisel carries connections with channels of an SSH connection to chisel server over WebSocket.
+// Channels are opened directly rather than with chisel client, so that they can be half-closed.
+type Chisel struct {
+	logger    zerolog.Logger
+	config    ChiselConfig
+	server    string
+	proxyURL  *url.URL
+	sshConfig *ssh.ClientConfig
+
+	mu     sync.Mutex
+	conn   ssh.Conn
+	cancel context.CancelFunc
+}
+
+func NewChisel(logger zerolog.Logger, config ChiselConfig) *Chisel {
+	return &Chisel{
+		logger: logger,
+		config: config,
+	}
+}
+
+// Start connects to the server in background, and reconnects when disconnected
+func (c *Chisel) Start(ctx context.Context) error {
+	server, err := chiselServerURL(c.config.Server)
+	if err != nil {
+		return err
+	}
+	c.server = server
+
+	if c.config.Proxy != "" {
+		u, err := url.Parse(c.config.Proxy)
+		if err != nil {
+			return fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		if strings.HasPrefix(u.Scheme, "socks") && u.Scheme != "socks" && u.Scheme != "socks5h" {
+			return fmt.Errorf("unsupported proxy scheme %s (only socks5h:// or socks:// is supported)", u.Scheme)
+		}
+		c.proxyURL = u
+	}
+
+	user, pass := chshare.ParseAuth(c.config.Auth)
+	c.sshConfig = &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.Password(pass)},
+		ClientVersion:   "SSH-" + chshare.ProtocolVersion + "-client",
+		HostKeyCallback: c.verifyServer,
+		Timeout:         chiselSSHTimeout,
+	}
+
+	ctx, c.cancel = context.WithCancel(ctx)
+	go c.connectionLoop(ctx)
+	if c.config.Keepalive > 0 {
+		go c.keepalive(ctx)
+	}
+
+	return nil
+}
+
+func (c *Chisel) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	return c.dial(ctx, "", addr)
+}
+
+// DialUDP opens a channel carrying datagrams to addr. This requires mallet server on the remote side.
+func (c *Chisel) DialUDP(ctx context.Context, addr string) (net.Conn, error) {
+	return c.dial(ctx, UDPPrefix, addr)
+}
+
+func (c *Chisel) dial(ctx context.Context, prefix string, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// chisel joins host and port with a colon, so IPv6 addresses must be bracketed
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	remote := prefix + host + ":" + port
+
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return nil, errors.New("not connected to chisel server")
+	}
+
+	// ssh.Conn.OpenChannel does not take a context
+	type result struct {
+		channel ssh.Channel
+		err     error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		channel, reqs, err := conn.OpenChannel("chisel", []byte(remote))
+		if err == nil {
+			go ssh.DiscardRequests(reqs)
+		}
+		ch <- result{channel: channel, err: err}
+	}()
+
+	select {
+	case res := <-ch:
+		if res.err != nil {
+			// the server rejects the channel if it fails to connect
+			return nil, fmt.Errorf("failed to open a chisel stream to %s: %w", addr, res.err)
+		}
+		return &chiselConn{Channel: res.channel, addr: addr}, nil
+	case <-ctx.Done():
+		go func() {
+			if res := <-ch; res.channel != nil {
+				res.channel.Close()
+			}
+		}()
+		return nil, fmt.Errorf("failed to open a chisel stream to %s: %w", addr, ctx.Err())
+	}
+}
+
+// Close stops reconnecting and closes the connection to the chisel server
+func (c *Chisel) Close() error {
+	if c.cancel != nil {
+		c.cancel()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// Check sends a ping over the SSH connection to the server, which fails while it is disconnected
+func (c *Chisel) Check(ctx context.Context) error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	if conn == nil {
+		return errors.New("not connected to chisel server")
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, _, err := conn.SendRequest("ping", true, nil)
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// connectionLoop connects to the server and reconnects with backoff until ctx is done or retries run out
+func (c *Chisel) connectionLoop(ctx context.Context) {
+	maxInterval := c.config.MaxRetryInterval
+	if maxInterval < time.Second {
+		maxInterval = defaultChiselRetryInterval
+	}
+	b := &backoff.Backoff{Max: maxInterval}
+
+	for {
+		via := ""
+		if c.proxyURL != nil {
+			via = " via " + c.proxyURL.String()
+		}
+		c.logger.Info().Msgf("Connecting to %s%s", c.server, via)
+
+		err := c.connect(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			// connected once and disconnected, so retries start over
+			b.Reset()
+			continue
+		}
+
+		attempt := int(b.Attempt())
+		if c.config.MaxRetryCount >= 0 && attempt >= c.config.MaxRetryCount {
+			c.logger.Error().Err(err).Msgf("Gave up connecting to %s after %d retries", c.server, attempt)
+			return
+		}
+		d := b.Duration()
+		c.logger.Warn().Err(err).Msgf("Failed to connect to chisel server, retrying in %s", d)
+
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// connect establishes an SSH connection over WebSocket and blocks until it is disconnected
+func (c *Chisel) connect(ctx context.Context) error {
+	d := websocket.Dialer{
+		ReadBufferSize:   1024,
+		WriteBufferSize:  1024,
+		HandshakeTimeout: chiselHandshakeTimeout,
+		Subprotocols:     []string{chshare.ProtocolVersion},
+	}
+	if c.proxyURL != nil {
+		if strings.HasPrefix(c.proxyURL.Scheme, "socks") {
+			var auth *proxy.Auth
+			if c.proxyURL.User != nil {
+				pass, _ := c.proxyURL.User.Password()
+				auth = &proxy.Auth{User: c.proxyURL.User.Username(), Password: pass}
+			}
+			dialer, err := proxy.SOCKS5("tcp", c.proxyURL.Host, auth, proxy.Direct)
+			if err != nil {
+				return err
+			}
+			d.NetDial = dialer.Dial
+		} else {
+			d.Proxy = http.ProxyURL(c.proxyURL)
+		}
+	}
+
+	headers := http.Header{}
+	if c.config.Hostname != "" {
+		headers.Set("Host", c.config.Hostname)
+	}
+
+	wsConn, _, err := d.DialContext(ctx, c.server, headers)
+	if err != nil {
+		return err
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(chshare.NewWebSocketConn(wsConn), "", c.sshConfig)
+	if err != nil {
+		wsConn.Close()
+		return fmt.Errorf("failed to handshake: %w", err)
+	}
+
+	// no remote is declared since channels are opened on demand
+	conf, err := chshare.EncodeConfig(&chshare.Config{Version: chshare.BuildVersion})
+	if err != nil {
+		sshConn.Close()
+		return err
+	}
+	ok, reply, err := sshConn.SendRequest("config", true, conf)
+	if err != nil {
+		sshConn.Close()
+		return fmt.Errorf("failed to send config: %w", err)
+	}
+	if !ok {
+		sshConn.Close()
+		return fmt.Errorf("config is rejected: %s", reply)
+	}
+
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		// reverse remotes are not supported
+		for ch := range chans {
+			ch.Reject(ssh.Prohibited, "channels are not accepted by mallet")
+		}
+	}()
+
+	c.mu.Lock()
+	if ctx.Err() != nil {
+		c.mu.Unlock()
+		sshConn.Close()
+		return ctx.Err()
+	}
+	c.conn = sshConn
+	c.mu.Unlock()
+	c.logger.Info().Msgf("Connected to %s", c.server)
+
+	err = sshConn.Wait()
+	c.logger.Warn().Err(err).Msgf("Disconnected from %s", c.server)
+
+	c.mu.Lock()
+	if c.conn == sshConn {
+		c.conn = nil
+	}
+	c.mu.Unlock()
+
+	return nil
+}
+
+// keepalive sends pings to the server, and closes the connection if it does not respond so that it is reconnected
+func (c *Chisel) keepalive(ctx context.Context) {
+	tick := time.NewTicker(c.config.Keepalive)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+
+		c.mu.Lock()
+		conn := c.conn
+		c.mu.Unlock()
+		if conn == nil {
+			continue
+		}
+
+		checkCtx, cancel := context.WithTimeout(ctx, c.config.Keepalive)
+		err := c.Check(checkCtx)
+		cancel()
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		c.logger.Warn().Err(err).Msg("Chisel server did not respond to ping")
+		conn.Close()
+	}
+}
+
+func (c *Chisel) verifyServer(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	got := chshare.FingerprintKey(key)
+	if c.config.Fingerprint != "" && !strings.HasPrefix(got, c.config.Fingerprint) {
+		return fmt.Errorf("invalid fingerprint %s", got)
+	}
+	c.logger.Debug().Msgf("Fingerprint %s", got)
+	return nil
+}
+
+// chiselServerURL returns the WebSocket URL of server with the default scheme and port
+func chiselServerURL(server string) (string, error) {
+	if !strings.HasPrefix(server, "http") && !strings.HasPrefix(server, "ws") {
+		server = "http://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", err
+	}
+	if !regexp.MustCompile(`:\d+$`).MatchString(u.Host) {
+		if u.Scheme == "https" || u.Scheme == "wss" {
+			u.Host += ":443"
+		} else {
+			u.Host += ":80"
+		}
+	}
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	return u.String(), nil
+}
+
+// chiselConn is a connection over an SSH channel opened to chisel server
+type chiselConn struct {
+	ssh.Channel
+	addr string
+}
+
+func (c *chiselConn) LocalAddr() net.Addr {
+	return chiselAddr("chisel")
+}
+
+func (c *chiselConn) RemoteAddr() net.Addr {
+	return chiselAddr(c.addr)
+}
+
+// deadlines are not supported by SSH channels
+func (c *chiselConn) SetDeadline(t time.Time) error {
+	return errors.New("chisel stream does not support deadlines")
+}
+
+func (c *chiselConn) SetReadDeadline(t time.Time) error {
+	return errors.New("chisel stream does not support deadlines")
+}
+
+func (c *chiselConn) SetWriteDeadline(t time.Time) error {
+	return errors.New("chisel stream does not support deadlines")
+}
+
+type chiselAddr string
+
+func (a chiselAddr) Network() string {
+	return "chisel"
+}
+
+func (a chiselAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,147 @@
+package tunnel_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/ryotarai/mallet/pkg/server"
+	"github.com/ryotarai/mallet/pkg/tunnel"
+)
+
+// startChisel returns a chisel tunnel connected to mallet server
+func startChisel(t *testing.T) *tunnel.Chisel {
+	t.Helper()
+
+	s, err := server.New(zerolog.Nop(), server.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// find a free port for the server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverAddr := l.Addr().String()
+	l.Close()
+	if err := s.Start(serverAddr); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Stop() })
+
+	c := tunnel.NewChisel(zerolog.Nop(), tunnel.ChiselConfig{
+		Server:        "http://" + serverAddr,
+		Fingerprint:   s.Fingerprint(),
+		MaxRetryCount: -1,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	// streams cannot be opened until the client connects
+	for i := 0; ; i++ {
+		err := c.Check(ctx)
+		if err == nil {
+			break
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return c
+}
+
+// closedAddr returns an address where no one listens
+func closedAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestChiselDialRejected(t *testing.T) {
+	c := startChisel(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the server rejects the channel if it fails to connect
+	conn, err := c.Dial(ctx, closedAddr(t))
+	if err == nil {
+		conn.Close()
+		t.Fatal("Dial succeeded to a closed port")
+	}
+	if ctx.Err() != nil {
+		t.Errorf("Dial did not fail until the context is done: %v", err)
+	}
+}
+
+func TestChiselDialContextDone(t *testing.T) {
+	c := startChisel(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := c.Dial(ctx, closedAddr(t))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestChiselCheck(t *testing.T) {
+	c := startChisel(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Close()
+	if err := c.Check(ctx); err == nil {
+		t.Error("Check succeeded after Close")
+	}
+}
+
+func TestChiselCheckFingerprintMismatch(t *testing.T) {
+	s, err := server.New(zerolog.Nop(), server.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverAddr := closedAddr(t)
+	if err := s.Start(serverAddr); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	c := tunnel.NewChisel(zerolog.Nop(), tunnel.ChiselConfig{
+		Server:        "http://" + serverAddr,
+		Fingerprint:   "00:00:00",
+		MaxRetryCount: -1,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the HTTP server is up, but the SSH handshake never succeeds
+	time.Sleep(500 * time.Millisecond)
+	if err := c.Check(ctx); err == nil {
+		t.Error("Check succeeded without a verified SSH connection")
+	}
+}
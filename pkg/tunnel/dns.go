@@ -0,0 +1,72 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const remoteDNSTimeout = 5 * time.Second
+
+// RemoteDNS sends DNS queries over TCP to a DNS server on the remote side of the tunnel
+type RemoteDNS struct {
+	tunnel Tunnel
+	server string
+}
+
+// NewRemoteDNS returns RemoteDNS for server (host:port, port 53 if omitted)
+func NewRemoteDNS(tunnel Tunnel, server string) *RemoteDNS {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &RemoteDNS{
+		tunnel: tunnel,
+		server: server,
+	}
+}
+
+// Server returns the address of the DNS server
+func (d *RemoteDNS) Server() string {
+	return d.server
+}
+
+// Exchange sends a query and returns the response
+func (d *RemoteDNS) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, remoteDNSTimeout)
+	defer cancel()
+
+	conn, err := d.tunnel.Dial(ctx, d.server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", d.server, err)
+	}
+	defer conn.Close()
+
+	// channels of SSH connections do not support deadlines, so the connection is closed on timeout instead
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	// dns.Conn uses TCP framing since conn is not a net.PacketConn
+	co := &dns.Conn{Conn: conn}
+	if err := co.WriteMsg(req); err != nil {
+		return nil, err
+	}
+	resp, err := co.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if resp.Id != req.Id {
+		return nil, dns.ErrId
+	}
+
+	return resp, nil
+}
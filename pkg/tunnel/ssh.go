@@ -0,0 +1,358 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const sshDialTimeout = 30 * time.Second
+
+// SSHConfig is the configuration of an SSH tunnel.
+// Parameters not specified are read from ~/.ssh/config.
+type SSHConfig struct {
+	// Destination is [user@]host[:port]. host may be an alias in ~/.ssh/config.
+	Destination string
+	// IdentityFiles are private keys used in addition to keys in ssh-agent
+	IdentityFiles []string
+	// KnownHostsFiles are used to verify the host key of the server
+	KnownHostsFiles []string
+	// Keepalive is the interval to check the connection and reconnect (0 to disable)
+	Keepalive time.Duration
+}
+
+// SSH carries connections with direct-tcpip channels of an SSH connection,
+// so that no software is required on the remote host
+type SSH struct {
+	logger       zerolog.Logger
+	config       SSHConfig
+	addr         string
+	clientConfig *ssh.ClientConfig
+
+	mu     sync.Mutex
+	client *ssh.Client
+	cancel context.CancelFunc
+}
+
+func NewSSH(logger zerolog.Logger, config SSHConfig) *SSH {
+	return &SSH{
+		logger: logger,
+		config: config,
+	}
+}
+
+func (s *SSH) Start(ctx context.Context) error {
+	addr, clientConfig, err := s.buildClientConfig()
+	if err != nil {
+		return err
+	}
+	s.addr = addr
+	s.clientConfig = clientConfig
+
+	if _, err := s.connect(); err != nil {
+		return err
+	}
+
+	if s.config.Keepalive > 0 {
+		ctx, s.cancel = context.WithCancel(ctx)
+		go s.keepalive(ctx)
+	}
+
+	return nil
+}
+
+// Close stops keepalive and closes the SSH connection
+func (s *SSH) Close() error {
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client == nil {
+		return nil
+	}
+	err := s.client.Close()
+	s.client = nil
+	return err
+}
+
+func (s *SSH) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	client, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	// ssh.Client.Dial does not take a context
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := client.Dial("tcp", addr)
+		ch <- result{conn: conn, err: err}
+	}()
+
+	select {
+	case res := <-ch:
+		return res.conn, res.err
+	case <-ctx.Done():
+		go func() {
+			if res := <-ch; res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// Check sends a keepalive request to the server
+func (s *SSH) Check(ctx context.Context) error {
+	s.mu.Lock()
+	client := s.client
+	s.mu.Unlock()
+
+	if client == nil {
+		return errors.New("not connected")
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// connect returns the current client, connecting to the server if disconnected
+func (s *SSH) connect() (*ssh.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	s.logger.Info().Msgf("Connecting to %s", s.addr)
+	client, err := ssh.Dial("tcp", s.addr, s.clientConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", s.addr, err)
+	}
+	s.logger.Info().Msgf("Connected to %s", s.addr)
+	s.client = client
+
+	go func() {
+		err := client.Wait()
+		s.logger.Warn().Err(err).Msgf("Disconnected from %s", s.addr)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.client == client {
+			s.client = nil
+		}
+	}()
+
+	return client, nil
+}
+
+// keepalive closes the connection if the server does not respond, and reconnects
+func (s *SSH) keepalive(ctx context.Context) {
+	tick := time.NewTicker(s.config.Keepalive)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+
+		checkCtx, cancel := context.WithTimeout(ctx, s.config.Keepalive)
+		err := s.Check(checkCtx)
+		cancel()
+		if err == nil {
+			continue
+		}
+
+		s.mu.Lock()
+		if s.client != nil {
+			s.logger.Warn().Err(err).Msg("SSH server did not respond to keepalive")
+			s.client.Close()
+			s.client = nil
+		}
+		s.mu.Unlock()
+
+		if _, err := s.connect(); err != nil {
+			s.logger.Warn().Err(err).Msg("Failed to reconnect")
+		}
+	}
+}
+
+func (s *SSH) buildClientConfig() (string, *ssh.ClientConfig, error) {
+	home, err := sshHomeDir()
+	if err != nil {
+		return "", nil, err
+	}
+
+	user, host, port := parseSSHDestination(s.config.Destination)
+
+	hc, err := readSSHConfig(filepath.Join(home, ".ssh", "config"), host)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read ssh config: %w", err)
+	}
+	if user == "" {
+		user = hc.User
+	}
+	if user == "" {
+		user = sshUsername()
+	}
+	if port == "" {
+		port = hc.Port
+	}
+	if port == "" {
+		port = "22"
+	}
+	hostname := host
+	if hc.HostName != "" {
+		hostname = expandSSHPath(hc.HostName, home, host, user)
+	}
+
+	// keys in ssh-agent are tried first and then identity files
+	var signers []ssh.Signer
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err != nil {
+			s.logger.Warn().Err(err).Msg("Failed to connect to ssh-agent")
+		} else if agentSigners, err := agent.NewClient(conn).Signers(); err != nil {
+			s.logger.Warn().Err(err).Msg("Failed to get keys from ssh-agent")
+		} else {
+			signers = append(signers, agentSigners...)
+		}
+	}
+
+	identityFiles := s.config.IdentityFiles
+	identityFiles = append(identityFiles, hc.IdentityFiles...)
+	if len(identityFiles) == 0 {
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			identityFiles = append(identityFiles, filepath.Join("~", ".ssh", name))
+		}
+	}
+	for _, file := range identityFiles {
+		file = expandSSHPath(file, home, host, user)
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				s.logger.Warn().Err(err).Msgf("Failed to read %s", file)
+			}
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			// encrypted keys should be added to ssh-agent
+			s.logger.Warn().Err(err).Msgf("Failed to load %s", file)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) == 0 {
+		return "", nil, errors.New("no SSH key is available in ssh-agent or identity files")
+	}
+
+	knownHostsFiles := s.config.KnownHostsFiles
+	if len(knownHostsFiles) == 0 {
+		knownHostsFiles = hc.KnownHostsFiles
+	}
+	if len(knownHostsFiles) == 0 {
+		knownHostsFiles = []string{"~/.ssh/known_hosts", "~/.ssh/known_hosts2", "/etc/ssh/ssh_known_hosts"}
+	}
+	var existingFiles []string
+	for _, file := range knownHostsFiles {
+		file = expandSSHPath(file, home, host, user)
+		if _, err := os.Stat(file); err == nil {
+			existingFiles = append(existingFiles, file)
+		}
+	}
+	if len(existingFiles) == 0 {
+		return "", nil, fmt.Errorf("no known_hosts file is found in %s", strings.Join(knownHostsFiles, ", "))
+	}
+	hostKeyCallback, err := knownhosts.New(existingFiles...)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to load known_hosts: %w", err)
+	}
+
+	addr := net.JoinHostPort(hostname, port)
+	return addr, &ssh.ClientConfig{
+		User:              user,
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgorithms(hostKeyCallback, addr),
+		Timeout:           sshDialTimeout,
+	}, nil
+}
+
+// hostKeyAlgorithms returns algorithms of keys in known_hosts for addr, like OpenSSH does.
+// Otherwise the server may choose a key of another type, which is rejected as a mismatch.
+func hostKeyAlgorithms(hostKeyCallback ssh.HostKeyCallback, addr string) []string {
+	// known keys are returned as an error for a key which is never known
+	var keyErr *knownhosts.KeyError
+	if err := hostKeyCallback(addr, &net.TCPAddr{IP: net.IPv4zero}, unknownKey{}); !errors.As(err, &keyErr) {
+		return nil
+	}
+
+	var types []string
+	for _, k := range keyErr.Want {
+		types = append(types, k.Key.Type())
+	}
+	sort.Strings(types)
+
+	var algos []string
+	for _, t := range types {
+		if t == ssh.KeyAlgoRSA {
+			// RSA keys are used with SHA-2 signatures if the server supports them
+			algos = append(algos, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algos = append(algos, t)
+	}
+	return algos
+}
+
+// unknownKey is a public key which matches no key in known_hosts
+type unknownKey struct{}
+
+func (unknownKey) Type() string                                 { return "unknown" }
+func (unknownKey) Marshal() []byte                              { return []byte("unknown") }
+func (unknownKey) Verify(data []byte, sig *ssh.Signature) error { return errors.New("unknown key") }
+
+// parseSSHDestination parses [user@]host[:port]
+func parseSSHDestination(dest string) (string, string, string) {
+	var user string
+	if i := strings.LastIndex(dest, "@"); i >= 0 {
+		user = dest[:i]
+		dest = dest[i+1:]
+	}
+
+	if host, port, err := net.SplitHostPort(dest); err == nil {
+		return user, host, port
+	}
+	return user, strings.Trim(dest, "[]"), ""
+}
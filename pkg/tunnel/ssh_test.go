@@ -0,0 +1,362 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/crypto/ssh"
+)
+
+// testSSHServer is an in-process SSH server which handles direct-tcpip channels and keepalive requests
+type testSSHServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  ssh.PublicKey
+
+	mu       sync.Mutex
+	conns    []net.Conn
+	accepted int
+}
+
+// The ed25519 host key is known by the client, and extraHostKeys are offered too.
+func startTestSSHServer(t *testing.T, clientKey ssh.PublicKey, extraHostKeys ...ssh.Signer) *testSSHServer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "alice" && string(key.Marshal()) == string(clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key for %s", conn.User())
+		},
+	}
+	config.AddHostKey(hostKey)
+	for _, key := range extraHostKeys {
+		config.AddHostKey(key)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := &testSSHServer{listener: l, config: config, hostKey: hostKey.PublicKey()}
+	go s.serve()
+	return s
+}
+
+func (s *testSSHServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+
+		go s.handle(conn)
+	}
+}
+
+func (s *testSSHServer) handle(conn net.Conn) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	s.mu.Lock()
+	s.accepted++
+	s.mu.Unlock()
+
+	go func() {
+		for req := range reqs {
+			req.Reply(req.Type == "keepalive@openssh.com", nil)
+		}
+	}()
+
+	for ch := range chans {
+		if ch.ChannelType() != "direct-tcpip" {
+			ch.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		var payload struct {
+			Host       string
+			Port       uint32
+			OriginHost string
+			OriginPort uint32
+		}
+		if err := ssh.Unmarshal(ch.ExtraData(), &payload); err != nil {
+			ch.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		dst, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+		if err != nil {
+			ch.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		stream, streamReqs, err := ch.Accept()
+		if err != nil {
+			dst.Close()
+			continue
+		}
+		go ssh.DiscardRequests(streamReqs)
+		go func() {
+			io.Copy(stream, dst)
+			stream.Close()
+		}()
+		go func() {
+			io.Copy(dst, stream)
+			dst.Close()
+		}()
+	}
+}
+
+// drop closes all connections as if the network was broken
+func (s *testSSHServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testSSHServer) acceptedCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.accepted
+}
+
+// startEchoServer starts a TCP server which sends data back
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// setupSSHHome starts a server and creates a home directory with ~/.ssh/config which defines host as an alias of it
+func setupSSHHome(t *testing.T, host string, extraHostKeys ...ssh.Signer) *testSSHServer {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := startTestSSHServer(t, sshPub, extraHostKeys...)
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SUDO_USER", "")
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	dir := filepath.Join(home, ".ssh")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "test_key"), pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	serverHost, serverPort, _ := net.SplitHostPort(server.listener.Addr().String())
+	config := fmt.Sprintf("Host %s\n  HostName %s\n  Port %s\n  User alice\n  IdentityFile ~/.ssh/test_key\n", host, serverHost, serverPort)
+	if err := ioutil.WriteFile(filepath.Join(dir, "config"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	knownHosts := fmt.Sprintf("[%s]:%s %s", serverHost, serverPort, ssh.MarshalAuthorizedKey(server.hostKey))
+	if err := ioutil.WriteFile(filepath.Join(dir, "known_hosts"), []byte(knownHosts), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return server
+}
+
+func echo(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Errorf("got %q, want %q", buf, msg)
+	}
+}
+
+func TestSSH(t *testing.T) {
+	server := setupSSHHome(t, "bastion")
+	echoAddr := startEchoServer(t)
+
+	s := NewSSH(zerolog.Nop(), SSHConfig{Destination: "bastion", Keepalive: 100 * time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, err := s.Dial(ctx, echoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, "hello")
+	conn.Close()
+
+	if err := s.Check(ctx); err != nil {
+		t.Errorf("Check failed: %v", err)
+	}
+
+	// keepalive reconnects after the server drops the connection
+	server.drop()
+	deadline := time.Now().Add(5 * time.Second)
+	for server.acceptedCount() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("did not reconnect after the connection was dropped")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	for {
+		if err := s.Check(ctx); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Check did not succeed after reconnecting")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	conn, err = s.Dial(ctx, echoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, "hello again")
+	conn.Close()
+}
+
+func TestSSHDialReconnects(t *testing.T) {
+	server := setupSSHHome(t, "bastion")
+	echoAddr := startEchoServer(t)
+
+	// without keepalive, Dial reconnects once the disconnection is noticed
+	s := NewSSH(zerolog.Nop(), SSHConfig{Destination: "bastion"})
+	ctx := context.Background()
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	server.drop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := s.Dial(ctx, echoAddr)
+		if err == nil {
+			echo(t, conn, "hello")
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Dial did not succeed after the connection was dropped: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if n := server.acceptedCount(); n != 2 {
+		t.Errorf("server accepted %d connections, want 2", n)
+	}
+}
+
+func TestSSHCheckNotConnected(t *testing.T) {
+	s := NewSSH(zerolog.Nop(), SSHConfig{})
+	if err := s.Check(context.Background()); err == nil {
+		t.Error("Check succeeded without connection")
+	}
+}
+
+func TestSSHHostKeyAlgorithms(t *testing.T) {
+	// the client prefers ECDSA to ed25519 unless it knows only the ed25519 key of the server
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(ecdsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupSSHHome(t, "bastion", signer)
+	echoAddr := startEchoServer(t)
+
+	s := NewSSH(zerolog.Nop(), SSHConfig{Destination: "bastion"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, err := s.Dial(ctx, echoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, "hello")
+	conn.Close()
+}
@@ -0,0 +1,144 @@
+package tunnel
+
+import (
+	"bufio"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// sshHostConfig is a subset of parameters in ssh_config(5) for a host
+type sshHostConfig struct {
+	HostName        string
+	User            string
+	Port            string
+	IdentityFiles   []string
+	KnownHostsFiles []string
+}
+
+// readSSHConfig returns parameters for host in the ssh_config file.
+// Like ssh(1), the first obtained value is used for each parameter.
+// "Match" blocks and "Include" are not supported.
+func readSSHConfig(file string, host string) (*sshHostConfig, error) {
+	c := &sshHostConfig{}
+
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	// parameters before the first Host line apply to all hosts
+	match := true
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value := splitSSHConfigLine(line)
+		switch key {
+		case "host":
+			match = matchSSHHost(strings.Fields(value), host)
+			continue
+		case "match":
+			match = false
+			continue
+		}
+		if !match {
+			continue
+		}
+
+		switch key {
+		case "hostname":
+			if c.HostName == "" {
+				c.HostName = value
+			}
+		case "user":
+			if c.User == "" {
+				c.User = value
+			}
+		case "port":
+			if c.Port == "" {
+				c.Port = value
+			}
+		case "identityfile":
+			// identity files are accumulated unlike other parameters
+			c.IdentityFiles = append(c.IdentityFiles, value)
+		case "userknownhostsfile":
+			if c.KnownHostsFiles == nil {
+				c.KnownHostsFiles = strings.Fields(value)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// splitSSHConfigLine splits "Key value" or "Key=value" into a lowercased key and the value
+func splitSSHConfigLine(line string) (string, string) {
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return strings.ToLower(line), ""
+	}
+	key := strings.ToLower(line[:i])
+	value := strings.TrimLeft(line[i:], " \t")
+	value = strings.TrimPrefix(value, "=")
+	value = strings.Trim(strings.TrimSpace(value), "\"")
+	return key, value
+}
+
+// matchSSHHost returns true if host matches any of patterns and none of negated ones
+func matchSSHHost(patterns []string, host string) bool {
+	matched := false
+	for _, p := range patterns {
+		negated := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+		if ok, _ := path.Match(p, host); ok {
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// expandSSHPath expands ~ and tokens (%d, %h, %r and %%) in a path in ssh_config
+func expandSSHPath(p string, home string, host string, remoteUser string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		p = filepath.Join(home, p[1:])
+	}
+	return strings.NewReplacer("%%", "%", "%d", home, "%h", host, "%r", remoteUser).Replace(p)
+}
+
+// sshHomeDir returns the home directory of the user who invoked mallet.
+// mallet usually runs with sudo, and keys and config files of the user are used rather than root's.
+func sshHomeDir() (string, error) {
+	if name := os.Getenv("SUDO_USER"); name != "" && os.Geteuid() == 0 {
+		if u, err := user.Lookup(name); err == nil {
+			return u.HomeDir, nil
+		}
+	}
+	return os.UserHomeDir()
+}
+
+// sshUsername returns the local username used as the default remote username
+func sshUsername() string {
+	if name := os.Getenv("SUDO_USER"); name != "" && os.Geteuid() == 0 {
+		return name
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
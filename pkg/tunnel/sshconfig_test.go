@@ -0,0 +1,134 @@
+package tunnel
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testSSHConfig = `# global defaults come first
+IdentityFile ~/.ssh/id_global
+
+Host bastion
+  HostName bastion.example.com
+  User alice
+  Port 2222
+  IdentityFile ~/.ssh/id_bastion
+
+Host *.internal !db.internal
+  User=bob
+  IdentityFile "~/.ssh/id_internal"
+  UserKnownHostsFile ~/.ssh/known_hosts_internal /etc/ssh/known_hosts_internal
+
+Match host db.internal
+  User carol
+
+Host *
+  User default
+  Port 22
+`
+
+func TestReadSSHConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config")
+	if err := ioutil.WriteFile(file, []byte(testSSHConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		host string
+		want sshHostConfig
+	}{
+		{
+			host: "bastion",
+			want: sshHostConfig{
+				HostName:      "bastion.example.com",
+				User:          "alice",
+				Port:          "2222",
+				IdentityFiles: []string{"~/.ssh/id_global", "~/.ssh/id_bastion"},
+			},
+		},
+		{
+			host: "app.internal",
+			want: sshHostConfig{
+				User:            "bob",
+				Port:            "22",
+				IdentityFiles:   []string{"~/.ssh/id_global", "~/.ssh/id_internal"},
+				KnownHostsFiles: []string{"~/.ssh/known_hosts_internal", "/etc/ssh/known_hosts_internal"},
+			},
+		},
+		{
+			// negated pattern excludes the host and Match blocks are ignored
+			host: "db.internal",
+			want: sshHostConfig{
+				User:          "default",
+				Port:          "22",
+				IdentityFiles: []string{"~/.ssh/id_global"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.host, func(t *testing.T) {
+			got, err := readSSHConfig(file, c.host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, c.want) {
+				t.Errorf("got %+v, want %+v", *got, c.want)
+			}
+		})
+	}
+}
+
+func TestReadSSHConfigNotExist(t *testing.T) {
+	got, err := readSSHConfig(filepath.Join(t.TempDir(), "config"), "bastion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*got, sshHostConfig{}) {
+		t.Errorf("got %+v", *got)
+	}
+}
+
+func TestExpandSSHPath(t *testing.T) {
+	cases := []struct {
+		path string
+		want string
+	}{
+		{"~", "/home/alice"},
+		{"~/.ssh/id_ed25519", "/home/alice/.ssh/id_ed25519"},
+		{"%d/.ssh/%r@%h", "/home/alice/.ssh/bob@bastion"},
+		{"/etc/ssh/100%%", "/etc/ssh/100%"},
+		{"~alice/key", "~alice/key"},
+	}
+
+	for _, c := range cases {
+		if got := expandSSHPath(c.path, "/home/alice", "bastion", "bob"); got != c.want {
+			t.Errorf("expandSSHPath(%q) = %q, want %q", c.path, got, c.want)
+		}
+	}
+}
+
+func TestParseSSHDestination(t *testing.T) {
+	cases := []struct {
+		dest string
+		user string
+		host string
+		port string
+	}{
+		{"bastion", "", "bastion", ""},
+		{"alice@bastion", "alice", "bastion", ""},
+		{"alice@bastion:2222", "alice", "bastion", "2222"},
+		{"alice@example.com@bastion", "alice@example.com", "bastion", ""},
+		{"[::1]:2222", "", "::1", "2222"},
+		{"[::1]", "", "::1", ""},
+	}
+
+	for _, c := range cases {
+		user, host, port := parseSSHDestination(c.dest)
+		if user != c.user || host != c.host || port != c.port {
+			t.Errorf("parseSSHDestination(%q) = (%q, %q, %q), want (%q, %q, %q)", c.dest, user, host, port, c.user, c.host, c.port)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+)
+
+// Tunnel carries TCP connections to destinations on the remote side
+type Tunnel interface {
+	Start(ctx context.Context) error
+	// Dial opens a connection to addr (host:port) via the tunnel
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+	// Check returns an error if the remote side of the tunnel is not reachable
+	Check(ctx context.Context) error
+	// Close disconnects from the remote side
+	Close() error
+}
@@ -0,0 +1,47 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// UDPPrefix is prepended to the remote address of chisel channels which carry UDP datagrams.
+// Only mallet server accepts them.
+const UDPPrefix = "udp/"
+
+// MaxDatagramSize is the maximum size of a datagram carried by the tunnel
+const MaxDatagramSize = 65535
+
+// UDPTunnel is implemented by tunnels which can carry UDP datagrams
+type UDPTunnel interface {
+	// DialUDP opens a stream to addr (host:port) which carries datagrams written by WriteDatagram
+	DialUDP(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// WriteDatagram writes b prefixed with its length in 2 bytes, which is the same framing as DNS over TCP
+func WriteDatagram(w io.Writer, b []byte) error {
+	if len(b) > MaxDatagramSize {
+		return fmt.Errorf("datagram is too large: %d bytes", len(b))
+	}
+
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadDatagram reads a datagram written by WriteDatagram into buf, which must be MaxDatagramSize bytes or larger
+func ReadDatagram(r io.Reader, buf []byte) ([]byte, error) {
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(buf[:2]))
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
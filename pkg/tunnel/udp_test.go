@@ -0,0 +1,60 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestDatagramRoundTrip(t *testing.T) {
+	datagrams := [][]byte{
+		[]byte("hello"),
+		{},
+		bytes.Repeat([]byte{0xff}, MaxDatagramSize),
+		[]byte("world"),
+	}
+
+	buf := &bytes.Buffer{}
+	for _, d := range datagrams {
+		if err := WriteDatagram(buf, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rbuf := make([]byte, MaxDatagramSize)
+	for i, want := range datagrams {
+		got, err := ReadDatagram(buf, rbuf)
+		if err != nil {
+			t.Fatalf("datagram %d: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("datagram %d: got %d bytes, want %d bytes", i, len(got), len(want))
+		}
+	}
+
+	if _, err := ReadDatagram(buf, rbuf); err != io.EOF {
+		t.Errorf("got %v after all datagrams, want EOF", err)
+	}
+}
+
+func TestWriteDatagramTooLarge(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := WriteDatagram(buf, make([]byte, MaxDatagramSize+1)); err == nil {
+		t.Error("no error for a too large datagram")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("%d bytes are written for a too large datagram", buf.Len())
+	}
+}
+
+func TestReadDatagramTruncated(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := WriteDatagram(buf, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf.Truncate(buf.Len() - 1)
+
+	if _, err := ReadDatagram(buf, make([]byte, MaxDatagramSize)); err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v, want ErrUnexpectedEOF", err)
+	}
+}